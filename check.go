@@ -0,0 +1,269 @@
+package ppow
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/cortesi/moddwatch/filter"
+	"github.com/dottedmag/ppow/conf"
+)
+
+// A Problem is something wrong with a config, found without running it
+type Problem struct {
+	// Check names the check that found the problem, e.g. "no-match"
+	Check string `json:"check"`
+	File  string `json:"file"`
+	// Line is 0 if the problem concerns the whole file
+	Line   int `json:"line,omitempty"`
+	Column int `json:"column,omitempty"`
+	// Block identifies the block the problem was found in, by its name or
+	// its patterns
+	Block   string `json:"block,omitempty"`
+	Message string `json:"message"`
+}
+
+func (p Problem) String() string {
+	pos := p.File
+	if p.Line > 0 {
+		pos += fmt.Sprintf(":%d", p.Line)
+		if p.Column > 0 {
+			pos += fmt.Sprintf(":%d", p.Column)
+		}
+	}
+	return fmt.Sprintf("%s: %s (%s)", pos, p.Message, p.Check)
+}
+
+// ParseProblems converts an error from reading a config into problems. Each
+// diagnostic of a parse error becomes a problem of its own.
+func ParseProblems(file string, err error) []Problem {
+	var perr *conf.ParseError
+	if !errors.As(err, &perr) {
+		return []Problem{{Check: "parse", File: file, Message: err.Error()}}
+	}
+	ret := make([]Problem, len(perr.Diagnostics))
+	for i, d := range perr.Diagnostics {
+		msg := d.Message
+		if d.Suggestion != "" {
+			msg += " (" + d.Suggestion + ")"
+		}
+		ret[i] = Problem{
+			Check:   "parse",
+			File:    d.File,
+			Line:    d.Line,
+			Column:  d.Column,
+			Message: msg,
+		}
+	}
+	return ret
+}
+
+// Variables that ppow provides when it runs a command
+var commandVariables = map[string]bool{
+	"@mods":    true,
+	"@dirmods": true,
+}
+
+// Words that aren't looked up on the PATH when they start a command
+var shellBuiltins = map[string]bool{
+	"!": true, ".": true, ":": true, "[": true, "[[": true, "alias": true,
+	"break": true, "builtin": true, "case": true, "cd": true, "command": true,
+	"continue": true, "declare": true, "echo": true, "eval": true, "exec": true,
+	"exit": true, "export": true, "false": true, "for": true, "function": true,
+	"getopts": true, "if": true, "kill": true, "local": true, "printf": true,
+	"pwd": true, "read": true, "readonly": true, "return": true, "set": true,
+	"shift": true, "source": true, "test": true, "time": true, "trap": true,
+	"true": true, "type": true, "ulimit": true, "umask": true, "unset": true,
+	"until": true, "wait": true, "while": true,
+}
+
+// Check analyses a config without running anything, and returns the problems
+// it finds: patterns that match no files or are always excluded, references to
+// undeclared variables, commands that aren't on the PATH, missing indir
+// directories and daemons that are started more than once. The config must
+// have the common excludes applied.
+func Check(cnf *conf.Config) []Problem {
+	var problems []Problem
+	globals := cnf.GetVariables()
+	shell, err := GetShellName(globals[shellVarName])
+	if err == nil {
+		_, err = CheckShell(shell)
+	}
+	if err != nil {
+		problems = append(problems, Problem{
+			Check:   "shell",
+			File:    cnf.VariableSource(shellVarName),
+			Message: err.Error(),
+		})
+		shell = ""
+	}
+	daemons := map[string]conf.Block{}
+	for _, b := range cnf.Blocks {
+		c := &checker{block: b, vars: b.Scope(globals)}
+		c.patterns()
+		if b.InDir != "" {
+			if st, err := os.Stat(b.InDir); err != nil {
+				c.problem("missing-indir", "indir %s doesn't exist", b.InDir)
+			} else if !st.IsDir() {
+				c.problem("missing-indir", "indir %s isn't a directory", b.InDir)
+			}
+		}
+		for _, p := range b.Preps {
+			c.command(p.Command, shell)
+		}
+		for _, d := range b.Daemons {
+			c.command(d.Command, shell)
+			key := b.InDir + "\x00" + d.Command
+			if other, ok := daemons[key]; ok {
+				c.problem(
+					"duplicate-daemon", "daemon %q is already run by block %s (%s:%d)",
+					d.Command, blockLabel(other), other.Source, other.Line,
+				)
+			} else {
+				daemons[key] = b
+			}
+		}
+		problems = append(problems, c.problems...)
+	}
+	return problems
+}
+
+// checker checks a single block
+type checker struct {
+	block    conf.Block
+	vars     map[string]string
+	problems []Problem
+}
+
+// blockLabel identifies a block in messages
+func blockLabel(b conf.Block) string {
+	if b.Name != "" {
+		return b.Name
+	}
+	if len(b.Include) == 0 {
+		return "{}"
+	}
+	return strings.Join(b.Include, " ")
+}
+
+func (c *checker) problem(check string, format string, args ...interface{}) {
+	c.problems = append(c.problems, Problem{
+		Check:   check,
+		File:    c.block.Source,
+		Line:    c.block.Line,
+		Block:   blockLabel(c.block),
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// excludeNote explains where an exclude pattern comes from, if it's one of
+// the common excludes
+func (c *checker) excludeNote(exclude string) string {
+	if c.block.NoCommonFilter {
+		return ""
+	}
+	for _, e := range CommonExcludes {
+		if e == exclude {
+			return "; it's a common exclude, which +noignore turns off"
+		}
+	}
+	return ""
+}
+
+// patterns checks that every watch pattern of the block can match a file
+func (c *checker) patterns() {
+	for _, p := range c.block.Include {
+		// An exclude that matches the pattern itself rules out everything
+		// the pattern could ever match
+		excluded := false
+		for _, e := range c.block.Exclude {
+			if m, _ := filter.MatchAny(p, []string{e}); m {
+				c.problem(
+					"unreachable", "pattern %q is always excluded by %q%s",
+					p, e, c.excludeNote(e),
+				)
+				excluded = true
+				break
+			}
+		}
+		if excluded {
+			continue
+		}
+		files, err := ListFiles(c.block.Root, []string{p}, nil)
+		if err != nil {
+			c.problem("no-match", "can't list the files matching %q: %s", p, err)
+			continue
+		}
+		if len(files) == 0 {
+			c.problem("no-match", "pattern %q matches no files", p)
+			continue
+		}
+		kept, _ := filter.Files(files, []string{p}, c.block.Exclude)
+		if len(kept) == 0 {
+			for _, e := range c.block.Exclude {
+				if m, _ := filter.MatchAny(files[0], []string{e}); m {
+					c.problem(
+						"unreachable", "every file matching %q is excluded, e.g. %s by %q%s",
+						p, files[0], e, c.excludeNote(e),
+					)
+					break
+				}
+			}
+		}
+	}
+}
+
+// command checks the variable references of a command, and that the program
+// it starts is on the PATH. Shell is empty if the shell isn't usable.
+func (c *checker) command(cmd string, shell string) {
+	rendered, err := conf.Expand(cmd, func(name string) (string, error) {
+		if v, ok := c.vars[name]; ok {
+			return v, nil
+		}
+		if !commandVariables[name] {
+			c.problem("undeclared-variable", "variable %s in command %q isn't declared", name, cmd)
+		}
+		return name, nil
+	})
+	if err != nil {
+		c.problem("undeclared-variable", "%s in command %q", err, cmd)
+		return
+	}
+	// PowerShell commands are mostly cmdlets, which aren't on the PATH
+	if shell == "" || shell == "powershell" {
+		return
+	}
+	prog := firstWord(rendered)
+	if prog == "" || shellBuiltins[prog] {
+		return
+	}
+	if _, err := exec.LookPath(prog); err != nil {
+		c.problem("command-not-found", "%s isn't on the PATH of %s", prog, shell)
+	}
+}
+
+// firstWord returns the name of the program a shell command starts with. It
+// returns an empty string if that can't be told without running the shell, or
+// if the program is named by a path rather than looked up on the PATH.
+func firstWord(cmd string) string {
+	for _, line := range strings.Split(cmd, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, w := range strings.Fields(line) {
+			// Skip environment assignments, like FOO=bar cmd
+			if i := strings.Index(w, "="); i > 0 && !strings.ContainsAny(w[:i], "/$") {
+				continue
+			}
+			if strings.ContainsAny(w, "/$`'\"\\(){}<>|&;*?~@") {
+				return ""
+			}
+			return w
+		}
+		return ""
+	}
+	return ""
+}
@@ -0,0 +1,97 @@
+package ppow
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dottedmag/ppow/conf"
+	"github.com/dottedmag/termlog"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCheck(t *testing.T) {
+	defer withTempDir(t)()
+	for _, f := range []string{"src/a.go", "docs/README"} {
+		if err := os.MkdirAll(filepath.Dir(f), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(f, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	text := "@dir = src\n" +
+		"src/** !docs/** {\n" +
+		"    prep: echo @dir @mods\n" +
+		"    daemon: true\n" +
+		"}\n" +
+		"missing/** {\n" +
+		"    name: web\n" +
+		"    indir: nowhere\n" +
+		"    daemon: ppow-no-such-command --port @port\n" +
+		"}\n" +
+		"docs/** !docs/README node_modules/** {\n" +
+		"    daemon: true\n" +
+		"}\n"
+	cnf, err := conf.Parse("ppow.conf", text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cnf.CommonExcludes(CommonExcludes)
+	indir, err := filepath.Abs("nowhere")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Problem{
+		{"no-match", "ppow.conf", 6, 0, "web", `pattern "missing/**" matches no files`},
+		{"missing-indir", "ppow.conf", 6, 0, "web", "indir " + indir + " doesn't exist"},
+		{"undeclared-variable", "ppow.conf", 6, 0, "web", `variable @port in command "ppow-no-such-command --port @port" isn't declared`},
+		{"command-not-found", "ppow.conf", 6, 0, "web", "ppow-no-such-command isn't on the PATH of sh"},
+		{"unreachable", "ppow.conf", 11, 0, "docs/** node_modules/**", `every file matching "docs/**" is excluded, e.g. docs/README by "docs/README"`},
+		{"unreachable", "ppow.conf", 11, 0, "docs/** node_modules/**", `pattern "node_modules/**" is always excluded by "**/node_modules/**"; it's a common exclude, which +noignore turns off`},
+		{"duplicate-daemon", "ppow.conf", 11, 0, "docs/** node_modules/**", `daemon "true" is already run by block src/** (ppow.conf:2)`},
+	}
+	if diff := cmp.Diff(expected, Check(cnf)); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestCheckNoEval(t *testing.T) {
+	defer withTempDir(t)()
+	text := "@rev = $(touch RAN)\n{\n    prep: echo @rev\n}\n"
+	if err := os.WriteFile("ppow.conf", []byte(text), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mr, err := NewModRunner("ppow.conf", termlog.NewLog(), nil, false, Options{NoEval: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat("RAN"); err == nil {
+		t.Error("Expected the computed variable not to be evaluated")
+	}
+	if v := mr.Config.GetVariables()["@rev"]; v != "$(touch RAN)" {
+		t.Errorf("Expected the unevaluated value, got %q", v)
+	}
+}
+
+var firstWordTests = []struct {
+	cmd      string
+	expected string
+}{
+	{"go test ./...", "go"},
+	{"  \n# comment\ngo build\nls", "go"},
+	{"CGO_ENABLED=0 go build", "go"},
+	{"./server --port 80", ""},
+	{"$GO build", ""},
+	{"(cd sub && make)", ""},
+	{"", ""},
+}
+
+func TestFirstWord(t *testing.T) {
+	for _, tt := range firstWordTests {
+		if ret := firstWord(tt.cmd); ret != tt.expected {
+			t.Errorf("%q: expected %q, got %q", tt.cmd, tt.expected, ret)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/dottedmag/ppow"
+	"github.com/dottedmag/termlog"
+	"github.com/spf13/pflag"
+)
+
+const checkUsage = `Usage: ppow check [--json] [-f FILE] [--var NAME=VALUE]... [--profile NAME]
+
+Loads a config without running anything, and reports problems with it. Exits
+with status 1 if there are any.
+`
+
+// checkCommand implements ppow check
+func checkCommand(args []string) int {
+	flags := pflag.NewFlagSet("check", pflag.ContinueOnError)
+	file := flags.StringP("file", "f", "", "Path to the config (defaults to ppow.conf with fallback to modd.conf)")
+	vars := flags.StringArray("var", nil, "Override a config variable, as name=value (repeatable)")
+	confroot := flags.Bool("confroot", false, "Resolve patterns, indir and @mods relative to the config's directory (default true if it isn't the current directory)")
+	profile := flags.String("profile", "", "Check this config profile instead of the default one")
+	asJSON := flags.Bool("json", false, "Print the problems as JSON")
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, checkUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err == pflag.ErrHelp {
+		return 0
+	} else if err != nil {
+		return 2
+	}
+	if *file == "" {
+		*file = defaultConfFile()
+	}
+	varValues, err := parseVars(*vars)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	var problems []ppow.Problem
+	opts := ppow.Options{Vars: varValues, Profile: *profile, NoEval: true}
+	opts.Root = confRoot(*file, *confroot, flags.Changed("confroot"))
+	mr, err := ppow.NewModRunner(*file, termlog.NewLog(), nil, false, opts)
+	if err != nil {
+		problems = ppow.ParseProblems(*file, err)
+	} else {
+		problems = ppow.Check(mr.Config)
+	}
+
+	if *asJSON {
+		if problems == nil {
+			problems = []ppow.Problem{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(map[string]interface{}{"problems": problems}); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	} else {
+		for _, p := range problems {
+			fmt.Println(p)
+		}
+	}
+	if len(problems) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/dottedmag/ppow"
+	"github.com/dottedmag/termlog"
+	"github.com/spf13/pflag"
+)
+
+const configUsage = `Usage: ppow config --json [-f FILE] [--var NAME=VALUE]... [--profile NAME]
+
+Prints the config as ppow resolves it: blocks with their patterns, common
+excludes and rendered daemon commands, and the values of variables. The output
+can be read back with ppow -f FILE.json.
+`
+
+// configCommand implements ppow config
+func configCommand(args []string) int {
+	flags := pflag.NewFlagSet("config", pflag.ContinueOnError)
+	file := flags.StringP("file", "f", "", "Path to the config (defaults to ppow.conf with fallback to modd.conf)")
+	vars := flags.StringArray("var", nil, "Override a config variable, as name=value (repeatable)")
+	only := flags.StringSlice("only", nil, "Only include the blocks with this name (repeatable)")
+	skip := flags.StringSlice("skip", nil, "Don't include the blocks with this name (repeatable)")
+	confroot := flags.Bool("confroot", false, "Resolve patterns, indir and @mods relative to the config's directory (default true if it isn't the current directory)")
+	profile := flags.String("profile", "", "Use this config profile instead of the default one")
+	asJSON := flags.Bool("json", false, "Print the config as JSON")
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, configUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err == pflag.ErrHelp {
+		return 0
+	} else if err != nil {
+		return 2
+	}
+	// JSON is the only format for now, but we want to be able to add others
+	if !*asJSON {
+		fmt.Fprintln(os.Stderr, "ppow config: --json is required")
+		flags.Usage()
+		return 2
+	}
+	if *file == "" {
+		*file = defaultConfFile()
+	}
+	varValues, err := parseVars(*vars)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	opts := ppow.Options{Only: *only, Skip: *skip, Vars: varValues, Profile: *profile}
+	opts.Root = confRoot(*file, *confroot, flags.Changed("confroot"))
+	mr, err := ppow.NewModRunner(*file, termlog.NewLog(), nil, false, opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	dump, err := ppow.DumpConfig(mr.Config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(dump); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
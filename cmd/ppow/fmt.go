@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/dottedmag/ppow/conf"
+	"github.com/spf13/pflag"
+)
+
+const fmtUsage = `Usage: ppow fmt [--check] [FILE...]
+
+Rewrites config files in canonical layout. Without arguments, formats
+ppow.conf in the current directory, or modd.conf if there's no ppow.conf.
+`
+
+// fmtCommand implements ppow fmt
+func fmtCommand(args []string) int {
+	flags := pflag.NewFlagSet("fmt", pflag.ContinueOnError)
+	check := flags.Bool("check", false, "Don't rewrite files, list the ones that aren't formatted and exit with status 1 if there are any")
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, fmtUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err == pflag.ErrHelp {
+		return 0
+	} else if err != nil {
+		return 2
+	}
+
+	files := flags.Args()
+	if len(files) == 0 {
+		files = []string{defaultConfFile()}
+		if files[0] == "" {
+			files[0] = "ppow.conf"
+		}
+	}
+
+	status := 0
+	for _, path := range files {
+		text, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 2
+			continue
+		}
+		formatted, err := conf.Format(path, string(text))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 2
+			continue
+		}
+		if bytes.Equal(text, formatted) {
+			continue
+		}
+		if *check {
+			fmt.Println(path)
+			if status == 0 {
+				status = 1
+			}
+			continue
+		}
+		if err := writeFile(path, formatted); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 2
+		}
+	}
+	return status
+}
+
+// writeFile replaces the contents of a file, keeping its permissions
+func writeFile(path string, data []byte) error {
+	st, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, st.Mode().Perm())
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/dottedmag/ppow/lsp"
+	"github.com/spf13/pflag"
+)
+
+const lspUsage = `Usage: ppow lsp
+
+Runs a Language Server Protocol server for ppow configs, talking to an editor
+over stdin and stdout.
+`
+
+// lspCommand implements ppow lsp
+func lspCommand(args []string) int {
+	flags := pflag.NewFlagSet("lsp", pflag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, lspUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err == pflag.ErrHelp {
+		return 0
+	} else if err != nil {
+		return 2
+	}
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return 2
+	}
+	if err := lsp.NewServer(os.Stdin, os.Stdout).Serve(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -3,19 +3,43 @@ package main
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/dottedmag/ppow"
 	"github.com/dottedmag/termlog"
 	"github.com/spf13/pflag"
 )
 
+// Subcommands, run as ppow NAME [ARGS...]. They return the exit status.
+var commands = map[string]func(args []string) int{
+	"check":  checkCommand,
+	"config": configCommand,
+	"fmt":    fmtCommand,
+	"lsp":    lspCommand,
+}
+
 func main() {
-	file := pflag.StringP("file", "f", "", "Path to modfile (defaults to ppow.conf with fallback to mmod.conf if not specified)")
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			os.Exit(cmd(os.Args[2:]))
+		}
+	}
+
+	files := pflag.StringArrayP("file", "f", nil, "Path to modfile (defaults to ppow.conf with fallback to mmod.conf if not specified; repeatable, to run several configs)")
 	noConf := pflag.BoolP("noconf", "c", false, "Don't watch our own config file")
 	beep := pflag.BoolP("bell", "b", false, "Ring terminal bell if any command returns an error")
 	ignores := pflag.BoolP("ignores", "i", false, "List default ignore patterns and exit")
 	doNotify := pflag.BoolP("notifiy", "n", false, "Send stderr to system notification if commands error")
 	prep := pflag.BoolP("prep", "p", false, "Run prep commands and exit")
+	recursive := pflag.BoolP("recursive", "r", false, "Also run the ppow.conf files in subdirectories, each relative to its own directory")
+	vars := pflag.StringArray("var", nil, "Override a config variable, as name=value (repeatable)")
+	only := pflag.StringSlice("only", nil, "Only run the blocks with this name (repeatable)")
+	skip := pflag.StringSlice("skip", nil, "Don't run the blocks with this name (repeatable)")
+	profile := pflag.String("profile", "", "Use this config profile instead of the default one")
+	jobs := pflag.IntP("jobs", "j", 1, "Run up to this many blocks at once; only blocks flagged with +concurrent run alongside others")
+	confroot := pflag.Bool("confroot", false, "Resolve patterns, indir and @mods relative to the config's directory (default true if it isn't the current directory)")
+	profiles := pflag.Bool("profiles", false, "List the profiles declared in the config and exit")
 	debug := pflag.Bool("debug", false, "Debugging for ppow development")
 	version := pflag.Bool("version", false, "Show application version")
 
@@ -51,19 +75,43 @@ func main() {
 		notifiers = append(notifiers, &ppow.BeepNotifier{})
 	}
 
-	if *file == "" && fileExists("ppow.conf") {
-		*file = "ppow.conf"
-	}
-	if *file == "" && fileExists("modd.conf") {
-		*file = "modd.conf"
+	file := defaultConfFile()
+	if len(*files) > 0 {
+		file = (*files)[0]
 	}
 
-	mr, err := ppow.NewModRunner(*file, log, notifiers, !(*noConf))
+	varValues, err := parseVars(*vars)
+	if err != nil {
+		log.Shout("%s", err)
+		return
+	}
+	opts := ppow.Options{Only: *only, Skip: *skip, Vars: varValues, Profile: *profile}
+	explicitRoot := pflag.CommandLine.Changed("confroot")
+	opts.Root = confRoot(file, *confroot, explicitRoot)
+	opts.Recursive = *recursive
+	opts.Jobs = *jobs
+	if len(*files) > 1 {
+		for _, f := range (*files)[1:] {
+			opts.Extra = append(opts.Extra, ppow.ExtraConfig{Path: f, Root: confRoot(f, *confroot, explicitRoot)})
+		}
+	}
+	mr, err := ppow.NewModRunner(file, log, notifiers, !(*noConf), opts)
 	if err != nil {
 		log.Shout("%s", err)
 		return
 	}
 
+	if *profiles {
+		for _, p := range mr.Config.Profiles {
+			if p == mr.Config.DefaultProfile {
+				fmt.Println(p, "(default)")
+			} else {
+				fmt.Println(p)
+			}
+		}
+		os.Exit(0)
+	}
+
 	if *prep {
 		err := mr.PrepOnly(true)
 		if err != nil {
@@ -77,6 +125,56 @@ func main() {
 	}
 }
 
+// defaultConfFile returns the config to use if none is given: ppow.conf, or
+// modd.conf for backward compatibility. It returns an empty string if neither
+// exists.
+func defaultConfFile() string {
+	if fileExists("ppow.conf") {
+		return "ppow.conf"
+	}
+	if fileExists("modd.conf") {
+		return "modd.conf"
+	}
+	return ""
+}
+
+// confRoot returns the root directory for a config: its directory if
+// --confroot is given, or if the flag isn't given and the config lives
+// elsewhere. Otherwise it returns an empty string, for the current directory.
+func confRoot(file string, confroot bool, explicit bool) string {
+	dir := filepath.Dir(file)
+	if explicit {
+		if confroot {
+			return dir
+		}
+		return ""
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return ""
+	}
+	cwd, err := os.Getwd()
+	if err != nil || abs == cwd {
+		return ""
+	}
+	return dir
+}
+
+// parseVars parses --var values of the form name=value. Names may have a
+// leading @.
+func parseVars(vars []string) (map[string]string, error) {
+	ret := map[string]string{}
+	for _, v := range vars {
+		name, value, ok := strings.Cut(v, "=")
+		name = strings.TrimPrefix(name, "@")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("Invalid --var %q, expected name=value", v)
+		}
+		ret[name] = value
+	}
+	return ret, nil
+}
+
 func fileExists(path string) bool {
 	_, err := os.Stat(path)
 	return err == nil
@@ -5,6 +5,7 @@ package conf
 import (
 	"fmt"
 	"os"
+	"sort"
 	"strings"
 	"syscall"
 )
@@ -20,6 +21,19 @@ var strSignals = map[string]os.Signal{
 	"sigwinch": syscall.SIGWINCH,
 }
 
+// DaemonOptions lists the options of daemon commands. Signal mappings, like
+// +sigterm->sigint, can be formed from any two of them.
+var DaemonOptions = signalOptions()
+
+func signalOptions() []string {
+	ret := make([]string, 0, len(strSignals))
+	for k := range strSignals {
+		ret = append(ret, "+"+k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
 func (b *Block) addDaemon(command string, options []string) error {
 	if b.Daemons == nil {
 		b.Daemons = []Daemon{}
@@ -28,8 +42,8 @@ func (b *Block) addDaemon(command string, options []string) error {
 		Command:       command,
 		RestartSignal: syscall.SIGHUP,
 	}
-	for _, v := range options {
-		v = strings.TrimPrefix(v, "+")
+	for _, opt := range options {
+		v := strings.TrimPrefix(opt, "+")
 		if strings.Contains(v, "->") {
 			strFrom, strTo, ok := strings.Cut(v, "->")
 			if !ok {
@@ -37,11 +51,11 @@ func (b *Block) addDaemon(command string, options []string) error {
 			}
 			from := strSignals[strFrom]
 			if from == nil {
-				return fmt.Errorf("unknown signal: %s", strFrom)
+				return unknownSignal(opt, strFrom)
 			}
 			to := strSignals[strTo]
 			if to == nil {
-				return fmt.Errorf("unknown signal: %s", strTo)
+				return unknownSignal(opt, strTo)
 			}
 			if d.SignalMapping == nil {
 				d.SignalMapping = map[os.Signal]os.Signal{}
@@ -50,7 +64,7 @@ func (b *Block) addDaemon(command string, options []string) error {
 		} else {
 			sig := strSignals[v]
 			if sig == nil {
-				return fmt.Errorf("unknown signal: %s", v)
+				return unknownSignal(opt, v)
 			}
 			d.RestartSignal = sig
 		}
@@ -58,3 +72,25 @@ func (b *Block) addDaemon(command string, options []string) error {
 	b.Daemons = append(b.Daemons, d)
 	return nil
 }
+
+// signalName returns the name of a signal, as used in daemon options
+func signalName(sig os.Signal) string {
+	for k, v := range strSignals {
+		if v == sig {
+			return k
+		}
+	}
+	return sig.String()
+}
+
+func unknownSignal(opt, name string) error {
+	if err := prepOption("+"+name, "unknown signal: "+name); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(strSignals))
+	for k := range strSignals {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return &optionError{opt, fmt.Sprintf("unknown signal: %s", name), didYouMean(name, names)}
+}
@@ -4,9 +4,13 @@ package conf
 
 import (
 	"fmt"
+	"os"
 	"syscall"
 )
 
+// DaemonOptions lists the options of daemon commands
+var DaemonOptions = []string{"+sighup", "+sigint", "+sigkill", "+sigquit", "+sigterm"}
+
 func (b *Block) addDaemon(command string, options []string) error {
 	if b.Daemons == nil {
 		b.Daemons = []Daemon{}
@@ -28,9 +32,31 @@ func (b *Block) addDaemon(command string, options []string) error {
 		case "+sigquit":
 			d.RestartSignal = syscall.SIGQUIT
 		default:
-			return fmt.Errorf("unknown option: %s", v)
+			if err := prepOption(v, "unknown option: "+v); err != nil {
+				return err
+			}
+			hint := didYouMean(v, DaemonOptions)
+			return &optionError{v, fmt.Sprintf("unknown option: %s", v), hint}
 		}
 	}
 	b.Daemons = append(b.Daemons, d)
 	return nil
 }
+
+var windowsSignals = map[string]os.Signal{
+	"sighup":  syscall.SIGHUP,
+	"sigint":  syscall.SIGINT,
+	"sigkill": syscall.SIGKILL,
+	"sigquit": syscall.SIGQUIT,
+	"sigterm": syscall.SIGTERM,
+}
+
+// signalName returns the name of a signal, as used in daemon options
+func signalName(sig os.Signal) string {
+	for k, v := range windowsSignals {
+		if v == sig {
+			return k
+		}
+	}
+	return sig.String()
+}
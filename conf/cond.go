@@ -0,0 +1,79 @@
+package conf
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// Prefixes of the options that restrict a block or command to some platforms,
+// or make it depend on a variable
+var conditionPrefixes = []string{"+os=", "+arch=", "+if="}
+
+// isCondition checks whether an option is a condition
+func isCondition(option string) bool {
+	for _, p := range conditionPrefixes {
+		if strings.HasPrefix(option, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitConditions separates conditions from other options
+func splitConditions(options []string) ([]string, []string) {
+	var rest, conds []string
+	for _, o := range options {
+		if isCondition(o) {
+			conds = append(conds, o)
+		} else {
+			rest = append(rest, o)
+		}
+	}
+	return rest, conds
+}
+
+// Values of +if conditions that count as false
+var falseValues = map[string]bool{
+	"":      true,
+	"0":     true,
+	"false": true,
+	"no":    true,
+	"off":   true,
+}
+
+// evalConditions checks whether all conditions hold. Variable references in
+// +if conditions are looked up in vars. Each condition can be negated with a
+// leading !, and +os and +arch take a comma-separated list of values.
+func evalConditions(conds []string, vars map[string]string) (bool, error) {
+	for _, c := range conds {
+		key, val, _ := strings.Cut(c, "=")
+		negate := strings.HasPrefix(val, "!")
+		val = strings.TrimPrefix(val, "!")
+		if val == "" {
+			return false, fmt.Errorf("empty condition: %s", c)
+		}
+		var ok bool
+		switch key {
+		case "+os":
+			ok = containsString(strings.Split(val, ","), runtime.GOOS)
+		case "+arch":
+			ok = containsString(strings.Split(val, ","), runtime.GOARCH)
+		case "+if":
+			v, err := Expand(val, func(name string) (string, error) {
+				if v, ok := vars[name]; ok {
+					return v, nil
+				}
+				return "", fmt.Errorf("unknown variable %s in condition %s", name, c)
+			})
+			if err != nil {
+				return false, err
+			}
+			ok = !falseValues[strings.ToLower(strings.TrimSpace(v))]
+		}
+		if ok == negate {
+			return false, nil
+		}
+	}
+	return true, nil
+}
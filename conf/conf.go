@@ -4,6 +4,9 @@ import (
 	"fmt"
 	"os"
 	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // A Daemon is a persistent process that is kept running
@@ -17,6 +20,22 @@ type Daemon struct {
 type Prep struct {
 	Command  string
 	Onchange bool // Should prep skip initial run
+	// AllowFail lets the block carry on if the command fails. The failure is
+	// still reported.
+	AllowFail bool
+	// Always runs the command even if an earlier prep failed
+	Always bool
+	// Parallel runs the command at the same time as the +parallel preps
+	// next to it
+	Parallel bool
+	// Timeout is how long the command may run before it's stopped. Zero
+	// means the default, set with @preptimeout.
+	Timeout time.Duration
+	// Retries is how many more times the command is run if it fails
+	Retries int
+	// Backoff is how long to wait before the first retry. The wait doubles
+	// with each retry after that.
+	Backoff time.Duration
 }
 
 // Block is a match pattern and a set of specifications
@@ -25,9 +44,52 @@ type Block struct {
 	Exclude        []string
 	NoCommonFilter bool
 	InDir          string
+	// Name is an optional identifier set with the name: option
+	Name string
+	// Source is the path of the file the block was declared in
+	Source string
+	// Line is the line of the source file the block starts on
+	Line int
+	// Strict stops daemons being restarted when a prep fails, even one with
+	// +allowfail
+	Strict bool
+	// Concurrent lets the block run at the same time as other blocks, when
+	// more than one job is allowed
+	Concurrent bool
+	// RestartOnChange stops the block's prep commands when new changes that
+	// match it arrive, and runs it again with those changes too
+	RestartOnChange bool
+	// Root is the directory the patterns are relative to, and that commands
+	// run in if there is no indir. It is empty for the current directory.
+	Root string
+	// Variables declared inside the block, which shadow global variables
+	Variables map[string]string
 
 	Daemons []Daemon
 	Preps   []Prep
+
+	// Conditions on the platform or variables, evaluated at the end of
+	// parsing, for the block itself and for each prep command and daemon
+	conditions       []string
+	prepConditions   [][]string
+	daemonConditions [][]string
+	// The profile section the block was declared in, until a profile is
+	// selected
+	profile string
+}
+
+// PrepOptions lists the options of prep commands
+var PrepOptions = []string{"+allowfail", "+always", "+onchange", "+parallel", "+retry=", "+timeout="}
+
+// prepOption returns an error for a prep option given to a daemon, with a
+// message in the form the caller uses, or nil for other options
+func prepOption(opt string, msg string) error {
+	for _, o := range PrepOptions {
+		if opt == o || strings.HasSuffix(o, "=") && strings.HasPrefix(opt, o) {
+			return &optionError{opt, msg, opt + " only applies to prep commands"}
+		}
+	}
+	return nil
 }
 
 func (b *Block) addPrep(command string, options []string) error {
@@ -35,26 +97,129 @@ func (b *Block) addPrep(command string, options []string) error {
 		b.Preps = []Prep{}
 	}
 
-	var onchange = false
+	prep := Prep{Command: command}
 	for _, v := range options {
 		switch v {
 		case "+onchange":
-			onchange = true
+			prep.Onchange = true
+		case "+allowfail":
+			prep.AllowFail = true
+		case "+always":
+			prep.Always = true
+		case "+parallel":
+			prep.Parallel = true
 		default:
-			return fmt.Errorf("unknown signal: %s", v)
+			if d, ok := strings.CutPrefix(v, "+timeout="); ok {
+				timeout, err := time.ParseDuration(d)
+				if err != nil || timeout <= 0 {
+					return &optionError{v, fmt.Sprintf("invalid timeout: %s", d), "use a duration like 90s or 5m"}
+				}
+				prep.Timeout = timeout
+				continue
+			}
+			if r, ok := strings.CutPrefix(v, "+retry="); ok {
+				if err := parseRetry(&prep, r); err != nil {
+					return &optionError{v, err.Error(), "use a count like +retry=3, or +retry=3,backoff=500ms"}
+				}
+				continue
+			}
+			hint := didYouMean(v, PrepOptions)
+			if strings.HasPrefix(v, "+sig") {
+				hint = "signal options only apply to daemons"
+			}
+			return &optionError{v, fmt.Sprintf("unknown prep option: %s", v), hint}
 		}
 	}
 
-	prep := Prep{command, onchange}
-
 	b.Preps = append(b.Preps, prep)
 	return nil
 }
 
+// parseRetry parses the value of a +retry= option: a count, optionally
+// followed by a backoff duration
+func parseRetry(prep *Prep, v string) error {
+	count, backoff, hasBackoff := strings.Cut(v, ",")
+	n, err := strconv.Atoi(count)
+	if err != nil || n <= 0 {
+		return fmt.Errorf("invalid retry count: %s", count)
+	}
+	prep.Retries = n
+	if hasBackoff {
+		d, ok := strings.CutPrefix(backoff, "backoff=")
+		if !ok {
+			return fmt.Errorf("unknown retry option: %s", backoff)
+		}
+		prep.Backoff, err = time.ParseDuration(d)
+		if err != nil || prep.Backoff < 0 {
+			return fmt.Errorf("invalid backoff: %s", d)
+		}
+	}
+	return nil
+}
+
+// Scope returns the variables visible to the block's commands: the given
+// globals, shadowed by the variables declared in the block itself. Block
+// variables may refer to globals and to each other.
+func (b *Block) Scope(globals map[string]string) map[string]string {
+	n := (&resolver{raw: b.Variables, outer: globals}).allOrRaw()
+	for k, v := range globals {
+		if _, ok := n[k]; !ok {
+			n[k] = v
+		}
+	}
+	return n
+}
+
+func (b *Block) addVariable(key string, value string) error {
+	if b.Variables == nil {
+		b.Variables = map[string]string{}
+	}
+	if _, ok := b.Variables[key]; ok {
+		return fmt.Errorf("variable %s shadows previous declaration", key)
+	}
+	b.Variables[key] = value
+	return nil
+}
+
 // Config represents a complete configuration
 type Config struct {
-	Blocks    []Block
+	Blocks []Block
+	// Includes lists the files pulled in by include statements, in the order
+	// they were read
+	Includes []string
+	// Profiles lists the profiles declared in the config, in order
+	Profiles []string
+	// DefaultProfile is the profile flagged with +default, if any
+	DefaultProfile string
+	// Profile is the profile in use, or empty if none is
+	Profile string
+
 	variables map[string]string
+	// Variables whose value is a default declared with ?=
+	defaults map[string]bool
+	// Where each variable was declared
+	sources map[string]position
+	// Variables whose value is computed by running a command
+	commands map[string]command
+	// Output of the commands, captured when the config was parsed
+	outputs map[string]string
+	// Variables declared in each profile, until a profile is selected
+	profileVariables map[string][]profileVariable
+	// root is the directory computed variables are evaluated in, or empty
+	// for the current directory
+	root string
+}
+
+// A profileVariable is a variable declared in a profile section
+type profileVariable struct {
+	declaration
+	pos position
+}
+
+// position is a location in a config file
+type position struct {
+	file string
+	line int
 }
 
 // IncludePatterns retrieves all include patterns from all blocks.
@@ -75,39 +240,264 @@ func (c *Config) IncludePatterns() []string {
 	return paths
 }
 
-func (c *Config) addBlock(b Block) {
+func (c *Config) addBlock(b Block) error {
+	if b.Name != "" {
+		// Blocks in different profiles can share a name, since only one
+		// profile is used. Conditional blocks are checked once their
+		// conditions are applied.
+		for _, o := range c.Blocks {
+			if o.Name == b.Name && (o.profile == "" || b.profile == "" || o.profile == b.profile) &&
+				len(o.conditions) == 0 && len(b.conditions) == 0 {
+				return fmt.Errorf("duplicate block name: %s", b.Name)
+			}
+		}
+	}
 	if c.Blocks == nil {
 		c.Blocks = []Block{}
 	}
 	c.Blocks = append(c.Blocks, b)
+	return nil
+}
+
+// findBlock returns the index of the block with the given name, or -1
+func (c *Config) findBlock(name string) int {
+	for i, b := range c.Blocks {
+		if b.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// HasBlock reports whether the config has a block with the given name
+func (c *Config) HasBlock(name string) bool {
+	return c.findBlock(name) >= 0
+}
+
+// SelectBlocks restricts the config to a subset of named blocks. If only is
+// not empty, just the blocks named in it are kept. Blocks named in skip are
+// then removed. It is an error to name a block that doesn't exist.
+func (c *Config) SelectBlocks(only []string, skip []string) error {
+	for _, n := range append(append([]string{}, only...), skip...) {
+		if !c.HasBlock(n) {
+			return fmt.Errorf("no block named %q", n)
+		}
+	}
+	c.FilterBlocks(only, skip)
+	return nil
+}
+
+// FilterBlocks is like SelectBlocks, but names of blocks that aren't in the
+// config are ignored. It is for configs run together, where a name only has
+// to exist in one of them.
+func (c *Config) FilterBlocks(only []string, skip []string) {
+	if len(only) == 0 && len(skip) == 0 {
+		return
+	}
+	blocks := []Block{}
+	for _, b := range c.Blocks {
+		if len(only) > 0 && !containsString(only, b.Name) {
+			continue
+		}
+		if containsString(skip, b.Name) {
+			continue
+		}
+		blocks = append(blocks, b)
+	}
+	if len(blocks) == 0 {
+		blocks = nil
+	}
+	c.Blocks = blocks
+}
+
+func containsString(lst []string, s string) bool {
+	for _, v := range lst {
+		if v == s {
+			return true
+		}
+	}
+	return false
 }
 
-func (c *Config) addVariable(key string, value string) error {
+func (c *Config) addVariable(key string, value string, cmd *command, pos position) error {
+	if _, ok := c.variables[key]; ok && !c.defaults[key] {
+		return fmt.Errorf("variable %s shadows previous declaration", key)
+	}
+	c.setVariable(key, value, cmd, pos)
+	return nil
+}
+
+// addDefault declares a default value for a variable, which is only used if
+// the variable isn't declared anywhere else.
+func (c *Config) addDefault(key string, value string, cmd *command, pos position) error {
+	if _, ok := c.variables[key]; ok {
+		if c.defaults[key] {
+			return fmt.Errorf("variable %s already has a default", key)
+		}
+		return nil
+	}
+	c.setVariable(key, value, cmd, pos)
+	if c.defaults == nil {
+		c.defaults = map[string]bool{}
+	}
+	c.defaults[key] = true
+	return nil
+}
+
+// addProfile records a profile. A profile may be declared in several
+// sections, but only one profile can be the default.
+func (c *Config) addProfile(name string, isDefault bool) error {
+	if isDefault {
+		if c.DefaultProfile != "" && c.DefaultProfile != name {
+			return fmt.Errorf("profile %s is already the default", c.DefaultProfile)
+		}
+		c.DefaultProfile = name
+	}
+	if !containsString(c.Profiles, name) {
+		c.Profiles = append(c.Profiles, name)
+	}
+	return nil
+}
+
+// addProfileVariable sets aside a variable declared in a profile. When the
+// profile is selected, its variables replace global declarations.
+func (c *Config) addProfileVariable(profile string, d declaration, pos position) error {
+	for _, v := range c.profileVariables[profile] {
+		if v.name == d.name {
+			return fmt.Errorf("variable %s shadows previous declaration", d.name)
+		}
+	}
+	if c.profileVariables == nil {
+		c.profileVariables = map[string][]profileVariable{}
+	}
+	c.profileVariables[profile] = append(c.profileVariables[profile], profileVariable{d, pos})
+	return nil
+}
+
+// override replaces the value of a variable in the global scope and in every
+// block that declares it.
+func (c *Config) override(key string, value string, pos position) {
+	c.setVariable(key, value, nil, pos)
+	for _, b := range c.Blocks {
+		if _, ok := b.Variables[key]; ok {
+			b.Variables[key] = value
+		}
+	}
+}
+
+// setVariable declares a variable, replacing any previous declaration. If cmd
+// is not nil, the value of the variable is computed by running it.
+func (c *Config) setVariable(key string, value string, cmd *command, pos position) {
+	delete(c.defaults, key)
+	delete(c.commands, key)
+	delete(c.outputs, key)
+	if cmd != nil {
+		if c.commands == nil {
+			c.commands = map[string]command{}
+		}
+		c.commands[key] = *cmd
+	}
 	if c.variables == nil {
 		c.variables = map[string]string{}
 	}
-	if _, ok := c.variables[key]; ok {
-		return fmt.Errorf("variable %s shadows previous declaration", key)
+	if c.sources == nil {
+		c.sources = map[string]position{}
 	}
 	c.variables[key] = value
-	return nil
+	c.sources[key] = pos
 }
 
-// GetVariables returns a copy of the Variables map
+// disableBlocks removes the blocks identified by d, and returns the number of
+// blocks removed. If d has a name, the block with that name is removed,
+// otherwise all blocks with exactly the same include and exclude patterns are.
+func (c *Config) disableBlocks(d *Block) int {
+	blocks := []Block{}
+	for _, b := range c.Blocks {
+		if d.Name != "" && b.Name == d.Name {
+			continue
+		}
+		if d.Name == "" && equalStrings(b.Include, d.Include) && equalStrings(b.Exclude, d.Exclude) {
+			continue
+		}
+		blocks = append(blocks, b)
+	}
+	removed := len(c.Blocks) - len(blocks)
+	if len(blocks) == 0 {
+		blocks = nil
+	}
+	c.Blocks = blocks
+	return removed
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// VariableSource returns the path of the file a variable was declared in
+func (c *Config) VariableSource(key string) string {
+	return c.sources[key].file
+}
+
+// GetVariables returns a copy of the Variables map, with references to other
+// variables in the values expanded. Computed variables have the value their
+// command produced when the config was parsed.
 func (c *Config) GetVariables() map[string]string {
-	n := map[string]string{}
-	for k, v := range c.variables {
-		n[k] = v
+	return (&resolver{raw: c.variables, fixed: c.outputs}).allOrRaw()
+}
+
+// TriggerVariables is like GetVariables, but re-runs the commands of computed
+// variables declared with +ontrigger, using eval. Variables that refer to them
+// are expanded with the new values.
+func (c *Config) TriggerVariables(eval EvalFunc) (map[string]string, error) {
+	fixed := map[string]string{}
+	commands := map[string]command{}
+	for k, v := range c.outputs {
+		if c.commands[k].perTrigger {
+			commands[k] = c.commands[k]
+		} else {
+			fixed[k] = v
+		}
 	}
-	return n
+	if len(commands) == 0 {
+		return c.GetVariables(), nil
+	}
+	r := &resolver{raw: c.variables, fixed: fixed, commands: commands, eval: eval, dir: c.root}
+	return r.all()
+}
+
+// evalCommands runs the commands of all computed variables, and stores their
+// output
+func (c *Config) evalCommands(eval EvalFunc) error {
+	r := &resolver{raw: c.variables, commands: c.commands, eval: eval, dir: c.root}
+	if _, err := r.all(); err != nil {
+		return err
+	}
+	c.outputs = map[string]string{}
+	for k := range c.commands {
+		c.outputs[k] = r.done[k]
+	}
+	return nil
 }
 
 // CommonExcludes extends all blocks that require it with a common exclusion
-// set
+// set. Excludes a block already has aren't added again, so that a config read
+// back from its JSON form stays the same.
 func (c *Config) CommonExcludes(excludes []string) {
 	for i, b := range c.Blocks {
 		if !b.NoCommonFilter {
-			b.Exclude = append(b.Exclude, excludes...)
+			for _, e := range excludes {
+				if !containsString(b.Exclude, e) {
+					b.Exclude = append(b.Exclude, e)
+				}
+			}
 		}
 		c.Blocks[i] = b
 	}
@@ -18,3 +18,67 @@ func TestWatchPaths(t *testing.T) {
 		t.Errorf("Expected %#v, got %#v", expected, got)
 	}
 }
+
+func TestSelectBlocks(t *testing.T) {
+	blocks := []Block{{Name: "api"}, {Name: "web"}, {}, {Name: "db"}}
+	tests := []struct {
+		only     []string
+		skip     []string
+		expected []string
+	}{
+		{nil, nil, []string{"api", "web", "", "db"}},
+		{[]string{"api", "db"}, nil, []string{"api", "db"}},
+		{nil, []string{"web"}, []string{"api", "", "db"}},
+		{[]string{"api", "web"}, []string{"web"}, []string{"api"}},
+	}
+	for i, tt := range tests {
+		c := Config{Blocks: append([]Block{}, blocks...)}
+		if err := c.SelectBlocks(tt.only, tt.skip); err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+		got := []string{}
+		for _, b := range c.Blocks {
+			got = append(got, b.Name)
+		}
+		if !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("%d: Expected %#v, got %#v", i, tt.expected, got)
+		}
+	}
+
+	c := Config{Blocks: blocks}
+	if err := c.SelectBlocks([]string{"nonexistent"}, nil); err == nil {
+		t.Error("Expected error for unknown block name")
+	}
+}
+
+func TestGetVariables(t *testing.T) {
+	c, err := Parse("", `
+@root = /srv
+@dst = @root/dst
+@static = "@dst/static"
+@escaped = \@dst/@unknown
+{
+    @sub = @static/sub
+    @root = /block
+    prep: true
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"@root":    "/srv",
+		"@dst":     "/srv/dst",
+		"@static":  "/srv/dst/static",
+		"@escaped": "@dst/@unknown",
+	}
+	got := c.GetVariables()
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %#v, got %#v", expected, got)
+	}
+
+	scope := c.Blocks[0].Scope(got)
+	if scope["@sub"] != "/srv/dst/static/sub" || scope["@root"] != "/block" {
+		t.Errorf("Unexpected block scope %#v", scope)
+	}
+}
@@ -0,0 +1,66 @@
+package conf
+
+import "strings"
+
+// A Context describes what encloses a position of a config file, so that an
+// editor can tell what may be written there
+type Context struct {
+	// InBlock is set if the position is in the body of a block
+	InBlock bool
+	// InProfile is set if the position is in a profile section, outside any
+	// block
+	InProfile bool
+	// Directive is the keyword of the directive the position is in, like
+	// "daemon", if any
+	Directive string
+	// InValue is set if the position is in the value of a directive or a
+	// variable declaration, rather than among its options
+	InValue bool
+}
+
+// ContextAt lexes a config file up to a position, and returns the context at
+// that position. The file doesn't have to be valid, or complete: it's usually
+// being edited.
+func ContextAt(text string, pos Pos) Context {
+	text = text[:pos]
+	var ctx Context
+	// For each open brace, whether it opened a profile section
+	var open []bool
+	profile := false
+	l := lex("", text)
+	for {
+		itm := l.nextItem()
+		switch itm.typ {
+		case itemEOF:
+			ctx.InBlock = len(open) > 0 && !open[len(open)-1]
+			ctx.InProfile = len(open) > 0 && open[len(open)-1]
+			return ctx
+		case itemSpace, itemComment, itemError:
+			// Errors are left as they are, so that a half-written line gets
+			// the context of what comes before it
+			continue
+		case itemProfile:
+			profile = true
+		case itemLeftParen:
+			open = append(open, profile)
+			profile = false
+			ctx = Context{}
+		case itemRightParen:
+			if len(open) > 0 {
+				open = open[:len(open)-1]
+			}
+			ctx = Context{}
+		case itemInDir, itemName, itemPrep, itemDaemon:
+			ctx = Context{Directive: itm.val}
+		case itemColon, itemEquals, itemDefaultEquals:
+			ctx.InValue = true
+		case itemVarName:
+			ctx = Context{}
+		case itemBareString, itemQuotedString:
+			// A value ends the directive, unless it runs up to the position
+			if ctx.InValue && (int(itm.pos)+len(itm.val) < len(text) || strings.HasSuffix(itm.val, "\n")) {
+				ctx = Context{}
+			}
+		}
+	}
+}
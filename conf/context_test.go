@@ -0,0 +1,38 @@
+package conf
+
+import (
+	"strings"
+	"testing"
+)
+
+// The position is marked with a |
+var contextTests = []struct {
+	input    string
+	expected Context
+}{
+	{"|", Context{}},
+	{"foo |", Context{}},
+	{"foo {\n    |", Context{InBlock: true}},
+	{"foo {\n    pre|\n}", Context{InBlock: true}},
+	{"foo {\n    daemon +sig|", Context{InBlock: true, Directive: "daemon"}},
+	{"foo {\n    prep +onchange: go |", Context{InBlock: true, Directive: "prep", InValue: true}},
+	{"foo {\n    prep: 'go |'\n}", Context{InBlock: true, Directive: "prep", InValue: true}},
+	{"foo {\n    prep: go \\\n        |", Context{InBlock: true, Directive: "prep", InValue: true}},
+	{"foo {\n    prep: go test\n    |\n}", Context{InBlock: true}},
+	{"foo {\n    @a = |", Context{InBlock: true, InValue: true}},
+	{"foo {\n}\n|", Context{}},
+	{"profile ci {\n    |", Context{InProfile: true}},
+	{"profile ci {\n    foo {\n        indir: |", Context{InBlock: true, Directive: "indir", InValue: true}},
+	{"profile ci {\n    foo {\n    }\n    |", Context{InProfile: true}},
+	{"foo {\n    prep: a # b\n    |", Context{InBlock: true}},
+}
+
+func TestContextAt(t *testing.T) {
+	for _, tt := range contextTests {
+		pos := strings.Index(tt.input, "|")
+		text := tt.input[:pos] + tt.input[pos+1:]
+		if ret := ContextAt(text, Pos(pos)); ret != tt.expected {
+			t.Errorf("%q: expected %+v, got %+v", tt.input, tt.expected, ret)
+		}
+	}
+}
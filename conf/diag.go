@@ -0,0 +1,126 @@
+package conf
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A Diagnostic describes a problem found in a config file
+type Diagnostic struct {
+	File string
+	// Line and Column are 1-based. Column is 0 if the problem concerns a
+	// whole line, and Line is 0 if it concerns the whole file.
+	Line   int
+	Column int
+	// Token is the text the problem was found at, if any
+	Token   string
+	Message string
+	// Suggestion is a hint for fixing the problem, if we have one
+	Suggestion string
+}
+
+func (d Diagnostic) Error() string {
+	s := d.File
+	if d.Line > 0 {
+		s += fmt.Sprintf(":%d", d.Line)
+		if d.Column > 0 {
+			s += fmt.Sprintf(":%d", d.Column)
+		}
+	}
+	s += ": " + d.Message
+	if d.Suggestion != "" {
+		s += " (" + d.Suggestion + ")"
+	}
+	return s
+}
+
+// ParseError is returned when a config can't be parsed. It holds every
+// problem that was found, in the order they were found.
+type ParseError struct {
+	Diagnostics []Diagnostic
+}
+
+func (e *ParseError) Error() string {
+	lines := make([]string, len(e.Diagnostics))
+	for i, d := range e.Diagnostics {
+		lines[i] = d.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// optionError reports an invalid command option, with a suggestion for
+// fixing it if we have one
+type optionError struct {
+	option string
+	msg    string
+	hint   string
+}
+
+func (e *optionError) Error() string {
+	return e.msg
+}
+
+// newDiagnostic describes a problem found at an item of a config file
+func newDiagnostic(file, input string, itm item, hint string, msg string) Diagnostic {
+	line, col := lineCol(input, itm.pos)
+	token := itm.val
+	if itm.typ == itemError {
+		token = itm.token
+	}
+	token, _, _ = strings.Cut(strings.TrimSpace(token), "\n")
+	return Diagnostic{
+		File:       file,
+		Line:       line,
+		Column:     col,
+		Token:      token,
+		Message:    msg,
+		Suggestion: hint,
+	}
+}
+
+// lineCol returns the 1-based line and column of a position in the input
+func lineCol(input string, pos Pos) (int, int) {
+	before := input[:pos]
+	line := 1 + strings.Count(before, "\n")
+	col := 1 + len([]rune(before[strings.LastIndex(before, "\n")+1:]))
+	return line, col
+}
+
+// didYouMean suggests the candidate closest to word, or returns an empty
+// string if none is close enough to be a likely typo.
+func didYouMean(word string, candidates []string) string {
+	best := ""
+	bestDist := 3
+	for _, c := range candidates {
+		d := editDistance(word, c)
+		if d < bestDist && d < len(c) {
+			best, bestDist = c, d
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf("did you mean %s?", best)
+}
+
+// editDistance computes the Levenshtein distance between two strings
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
@@ -0,0 +1,125 @@
+package conf
+
+import (
+	"bytes"
+	"strings"
+)
+
+// indent is the indentation of the body of a block or profile
+const indent = "    "
+
+// Format parses a config file, and returns it in canonical layout
+func Format(name string, text string) ([]byte, error) {
+	f, err := ParseSyntax(name, text)
+	if err != nil {
+		return nil, err
+	}
+	return f.Format(), nil
+}
+
+// Format prints the syntax tree in canonical layout: one statement or directive
+// per line, bodies indented by four spaces, single spaces between tokens, and
+// blank lines around blocks and profiles. Comments, quoting and blank lines
+// between statements are kept.
+func (f *File) Format() []byte {
+	pr := &printer{}
+	pr.nodes(f.Nodes, "")
+	return pr.buf.Bytes()
+}
+
+type printer struct {
+	buf bytes.Buffer
+}
+
+func (pr *printer) line(prefix string, words ...string) {
+	pr.buf.WriteString(prefix)
+	pr.buf.WriteString(strings.Join(words, " "))
+	pr.buf.WriteByte('\n')
+}
+
+// standsApart checks whether a node is set off from its neighbours by blank
+// lines
+func standsApart(n Node) bool {
+	switch n.(type) {
+	case *BlockStmt, *ProfileStmt:
+		return true
+	}
+	return false
+}
+
+func (pr *printer) nodes(nodes []Node, prefix string) {
+	for i, n := range nodes {
+		d := n.decoration()
+		if i > 0 && (d.BlankBefore || standsApart(n) || standsApart(nodes[i-1])) {
+			pr.buf.WriteByte('\n')
+		}
+		for _, c := range d.Comments {
+			pr.line(prefix, c.Text)
+		}
+		pr.node(n, prefix)
+	}
+}
+
+// withComment appends an optional line comment to a line
+func withComment(words []string, c *Token) []string {
+	if c != nil {
+		return append(words, c.Text)
+	}
+	return words
+}
+
+func texts(tokens []Token) []string {
+	ret := make([]string, len(tokens))
+	for i, t := range tokens {
+		ret[i] = t.Text
+	}
+	return ret
+}
+
+func (pr *printer) node(n Node, prefix string) {
+	switch n := n.(type) {
+	case *CommentGroup:
+	case *VarDecl:
+		words := append([]string{n.Name.Text}, texts(n.Options)...)
+		words = append(words, n.Op.Text, n.Value.Text)
+		pr.line(prefix, withComment(words, n.LineComment)...)
+	case *IncludeStmt:
+		pr.line(prefix, withComment([]string{n.Keyword.Text, n.Path.Text}, n.LineComment)...)
+	case *Directive:
+		words := append([]string{n.Keyword.Text}, texts(n.Options)...)
+		words[len(words)-1] += ":"
+		words = append(words, n.Value.Text)
+		pr.line(prefix, withComment(words, n.LineComment)...)
+	case *ProfileStmt:
+		words := append([]string{n.Keyword.Text, n.Name.Text}, texts(n.Options)...)
+		pr.body(prefix, words, n.Braces, n.Body, n.LineComment)
+	case *BlockStmt:
+		// Options go after the patterns, which keep their order
+		var words, flags []string
+		for _, p := range n.Patterns {
+			if blockFlags[p.Text] || isCondition(p.Text) {
+				flags = append(flags, p.Text)
+			} else {
+				words = append(words, p.Text)
+			}
+		}
+		if len(words) > 0 && (words[0] == "include" || words[0] == "profile") {
+			// A bare keyword at the start of the line would start a
+			// statement
+			words[0] = `"` + words[0] + `"`
+		}
+		pr.body(prefix, append(words, flags...), n.Braces, n.Body, n.LineComment)
+	}
+}
+
+// body prints a block or profile: its header, the nodes in its body, and its
+// closing brace.
+func (pr *printer) body(prefix string, header []string, br Braces, body []Node, comment *Token) {
+	if len(body) == 0 && br.OpenComment == nil {
+		pr.line(prefix, withComment(append(header, "{}"), comment)...)
+		return
+	}
+	pr.line(prefix, withComment(append(header, "{"), br.OpenComment)...)
+	pr.nodes(body, prefix+indent)
+	pr.line(prefix, withComment([]string{"}"}, comment)...)
+}
@@ -0,0 +1,124 @@
+package conf
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var formatTests = []struct {
+	input    string
+	expected string
+}{
+	{"", ""},
+	{"{}", "{}\n"},
+	{"  foo   bar\n{\n}", "foo bar {}\n"},
+	{
+		"@a=b\n@c  ?=  'd e'  # note\n@f +ontrigger   = $(date)",
+		"@a = b\n@c ?= 'd e' # note\n@f +ontrigger = $(date)\n",
+	},
+	{"include   'x.conf'", "include 'x.conf'\n"},
+	// Block options go after the patterns
+	{
+		"+noignore foo !bar\n+os=linux {\n\tprep +onchange :  a\n  daemon:'b'\n}",
+		"foo !bar +noignore +os=linux {\n    prep +onchange: a\n    daemon: 'b'\n}\n",
+	},
+	// Multi-line values are kept as written
+	{
+		"{\nprep: \"a\n   b\"\nprep: c \\\n  d\n}",
+		"{\n    prep: \"a\n   b\"\n    prep: c \\\n  d\n}\n",
+	},
+	// Blank lines are collapsed, and added around blocks
+	{
+		"@a = b\n\n\n\n@c = d\nfoo {\nprep: a\n\n\nprep: b\n\n}\nbar {}",
+		"@a = b\n\n@c = d\n\nfoo {\n    prep: a\n\n    prep: b\n}\n\nbar {}\n",
+	},
+	// Comments
+	{
+		"# head\n\n# a\n@a = b\nfoo # c\nbar { # d\n# e\nprep: a # not a comment\n# f\n} # g\n# h",
+		"# head\n\n# a\n@a = b\n\n# c\nfoo bar { # d\n    # e\n    prep: a # not a comment\n    # f\n} # g\n\n# h\n",
+	},
+	{
+		"profile ci   +default {\n@a = b\n{\nname: x\n}\n}",
+		"profile ci +default {\n    @a = b\n\n    {\n        name: x\n    }\n}\n",
+	},
+	{"\r\n{\r\nprep: a\r\n}\r\n", "{\n    prep: a\n}\n"},
+}
+
+func TestFormat(t *testing.T) {
+	for i, tt := range formatTests {
+		ret, err := Format("test", tt.input)
+		if err != nil {
+			t.Fatalf("%d: %q - %s", i, tt.input, err)
+		}
+		if diff := cmp.Diff(tt.expected, string(ret)); diff != "" {
+			t.Errorf("%d: %q\n%s", i, tt.input, diff)
+		}
+		again, err := Format("test", string(ret))
+		if err != nil {
+			t.Fatalf("%d: %q - %s", i, ret, err)
+		}
+		if string(again) != string(ret) {
+			t.Errorf("%d: formatting isn't idempotent:\n%s\n---\n%s", i, ret, again)
+		}
+	}
+}
+
+// Formatting must not change what a config means
+func TestFormatPreservesConfig(t *testing.T) {
+	for i, tt := range parseTests {
+		formatted, err := Format(tt.path, tt.input)
+		if err != nil {
+			t.Fatalf("%d: %q - %s", i, tt.input, err)
+		}
+		ret, err := Parse(tt.path, string(formatted))
+		if err != nil {
+			t.Fatalf("%d: %q - %s", i, formatted, err)
+		}
+		if diff := cmp.Diff(ret, tt.expected, parseCmpOptions...); diff != "" {
+			t.Errorf("%d: %q\n%s", i, formatted, diff)
+		}
+	}
+}
+
+var roundTripTests = []string{
+	"include{\nprep: a\n}",
+	"+os=linux include {}",
+	"profile{}",
+	"+foo/** bar +noignore {}",
+	"a +strict !+b c {}",
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	for i, src := range roundTripTests {
+		expected, err := Parse("test", src)
+		if err != nil {
+			t.Fatalf("%d: %q - %s", i, src, err)
+		}
+		formatted, err := Format("test", src)
+		if err != nil {
+			t.Fatalf("%d: %q - %s", i, src, err)
+		}
+		ret, err := Parse("test", string(formatted))
+		if err != nil {
+			t.Fatalf("%d: %q - %s", i, formatted, err)
+		}
+		if diff := cmp.Diff(expected, ret, parseCmpOptions...); diff != "" {
+			t.Errorf("%d: %q\n%s", i, formatted, diff)
+		}
+	}
+}
+
+func TestFormatErrors(t *testing.T) {
+	_, err := Format("test", "foo {\nprep: a\ndeamon: b\n")
+	var perr *ParseError
+	if !errors.As(err, &perr) {
+		t.Fatalf("Expected a ParseError, got %v", err)
+	}
+	expected := "test:3:1: unknown directive: deamon (did you mean daemon?)\n" +
+		"test:4:1: unterminated block (the block opened on line 1 needs a closing })"
+	if err.Error() != expected {
+		t.Errorf("Expected\n%q\ngot\n%q", expected, err.Error())
+	}
+}
@@ -0,0 +1,329 @@
+package conf
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// JSONConfig is the JSON form of a resolved config. Configs are written in
+// this form by ppow config --json, and can be read back with ParseJSON, so
+// that tools can generate configs without writing the DSL.
+type JSONConfig struct {
+	// Profile is the profile the config was resolved for, if any
+	Profile string `json:"profile,omitempty"`
+	// Variables holds the global variables, with references to other
+	// variables expanded. Names include the leading @. Like the patterns of
+	// blocks, values are escaped, so that reading them back doesn't expand
+	// them again.
+	Variables map[string]string `json:"variables"`
+	Blocks    []JSONBlock       `json:"blocks"`
+}
+
+// JSONBlock is the JSON form of a block. Source, Line and Root are only
+// written: blocks read from JSON belong to the JSON file, and their root is
+// set by the options they are read with.
+type JSONBlock struct {
+	Name   string `json:"name,omitempty"`
+	Source string `json:"source,omitempty"`
+	Line   int    `json:"line,omitempty"`
+	// Root is the directory the patterns are relative to, if it isn't the
+	// current directory
+	Root    string   `json:"root,omitempty"`
+	Include []string `json:"include"`
+	// Exclude includes the common excludes, unless NoIgnore is set
+	Exclude         []string `json:"exclude,omitempty"`
+	NoIgnore        bool     `json:"noignore,omitempty"`
+	Strict          bool     `json:"strict,omitempty"`
+	Concurrent      bool     `json:"concurrent,omitempty"`
+	RestartOnChange bool     `json:"restartonchange,omitempty"`
+	InDir           string   `json:"indir,omitempty"`
+	// Variables holds the variables declared in the block, with references
+	// expanded
+	Variables map[string]string `json:"variables,omitempty"`
+	Preps     []JSONPrep        `json:"preps,omitempty"`
+	Daemons   []JSONDaemon      `json:"daemons,omitempty"`
+}
+
+// JSONPrep is the JSON form of a prep command
+type JSONPrep struct {
+	Command   string `json:"command"`
+	Onchange  bool   `json:"onchange,omitempty"`
+	AllowFail bool   `json:"allowfail,omitempty"`
+	Always    bool   `json:"always,omitempty"`
+	Parallel  bool   `json:"parallel,omitempty"`
+	// Timeout is a duration, like "90s"
+	Timeout string `json:"timeout,omitempty"`
+	Retry   int    `json:"retry,omitempty"`
+	// Backoff is a duration, like "500ms"
+	Backoff string `json:"backoff,omitempty"`
+}
+
+// JSONDaemon is the JSON form of a daemon. Signals are named like the daemon
+// options, without the +: "sigterm".
+type JSONDaemon struct {
+	Command string `json:"command"`
+	// Rendered is the command with variables expanded, as it is run. It is
+	// only written, and is ignored when the config is read.
+	Rendered string `json:"rendered,omitempty"`
+	// Signal is the signal that restarts the daemon
+	Signal string `json:"signal,omitempty"`
+	// SignalMap maps signals received by ppow to the signals passed on to the
+	// daemon
+	SignalMap map[string]string `json:"signalmap,omitempty"`
+}
+
+// A valid variable name
+var jsonVarName = regexp.MustCompile(`^@\w+$`)
+
+// JSON returns the JSON form of the config
+func (c *Config) JSON() *JSONConfig {
+	globals := c.GetVariables()
+	ret := &JSONConfig{Profile: c.Profile, Variables: map[string]string{}, Blocks: []JSONBlock{}}
+	for k, v := range globals {
+		ret.Variables[k] = escape(v)
+	}
+	for _, b := range c.Blocks {
+		jb := JSONBlock{
+			Name:            b.Name,
+			Source:          b.Source,
+			Line:            b.Line,
+			Root:            b.Root,
+			Include:         escapeAll(b.Include),
+			Exclude:         escapeAll(b.Exclude),
+			NoIgnore:        b.NoCommonFilter,
+			Strict:          b.Strict,
+			Concurrent:      b.Concurrent,
+			RestartOnChange: b.RestartOnChange,
+			InDir:           escape(b.InDir),
+		}
+		if len(b.Variables) > 0 {
+			scope := b.Scope(globals)
+			jb.Variables = map[string]string{}
+			for k := range b.Variables {
+				jb.Variables[k] = escape(scope[k])
+			}
+		}
+		for _, p := range b.Preps {
+			jb.Preps = append(jb.Preps, JSONPrep{
+				Command:   p.Command,
+				Onchange:  p.Onchange,
+				AllowFail: p.AllowFail,
+				Always:    p.Always,
+				Parallel:  p.Parallel,
+				Timeout:   durationString(p.Timeout),
+				Retry:     p.Retries,
+				Backoff:   durationString(p.Backoff),
+			})
+		}
+		for _, d := range b.Daemons {
+			jd := JSONDaemon{Command: d.Command, Signal: signalName(d.RestartSignal)}
+			for from, to := range d.SignalMapping {
+				if jd.SignalMap == nil {
+					jd.SignalMap = map[string]string{}
+				}
+				jd.SignalMap[signalName(from)] = signalName(to)
+			}
+			jb.Daemons = append(jb.Daemons, jd)
+		}
+		ret.Blocks = append(ret.Blocks, jb)
+	}
+	return ret
+}
+
+// ParseJSON reads a config in the form written by Config.JSON. Variables in
+// patterns and indir are expanded, and the values of variables may refer to
+// each other, as in the DSL. Commands aren't run to compute variables, and
+// local override files aren't read: opts.Eval and opts.Local are ignored.
+func ParseJSON(name string, data []byte, opts Options) (*Config, error) {
+	var jc JSONConfig
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&jc); err != nil {
+		return nil, &ParseError{[]Diagnostic{jsonDiagnostic(name, data, err)}}
+	}
+	p := &parser{name: name, diagnostics: &[]Diagnostic{}, config: &Config{}}
+	p.try(func() { p.loadJSON(jc, opts) })
+	if p.failed() {
+		return nil, &ParseError{*p.diagnostics}
+	}
+	return p.config, nil
+}
+
+// jsonDiagnostic describes an error decoding JSON, at the position it was
+// found if we know it
+func jsonDiagnostic(name string, data []byte, err error) Diagnostic {
+	d := Diagnostic{File: name, Message: err.Error()}
+	var offset int64
+	var serr *json.SyntaxError
+	var terr *json.UnmarshalTypeError
+	if errors.As(err, &serr) {
+		offset = serr.Offset
+	} else if errors.As(err, &terr) {
+		offset = terr.Offset
+	}
+	// The offset is just past the byte the error was found at
+	if offset > 0 && offset <= int64(len(data)) {
+		d.Line, d.Column = lineCol(string(data), Pos(offset-1))
+	}
+	return d
+}
+
+// reportJSON records a problem with part of a JSON config
+func (p *parser) reportJSON(where string, err error) {
+	d := Diagnostic{File: p.name, Message: fmt.Sprintf("%s: %s", where, err)}
+	var oerr *optionError
+	if errors.As(err, &oerr) {
+		d.Suggestion = oerr.hint
+	}
+	*p.diagnostics = append(*p.diagnostics, d)
+}
+
+// loadJSON builds the config from its JSON form
+func (p *parser) loadJSON(jc JSONConfig, opts Options) {
+	c := p.config
+	p.setRoot(opts.Root)
+	if p.name != "" {
+		c.setVariable(confVarName, p.confDir(), nil, position{p.name, 0})
+	}
+	for _, k := range sortedKeys(jc.Variables) {
+		if !jsonVarName.MatchString(k) {
+			p.reportJSON("variables", fmt.Errorf("invalid variable name %q", k))
+			continue
+		}
+		c.setVariable(k, jc.Variables[k], nil, position{p.name, 0})
+	}
+
+	if jc.Profile != "" {
+		c.Profiles = []string{jc.Profile}
+		c.Profile = jc.Profile
+	}
+	if opts.Profile != "" && opts.Profile != jc.Profile {
+		if jc.Profile == "" {
+			p.errorAt(p.name, 0, "unknown profile %q: no profiles are declared", opts.Profile)
+		}
+		p.errorAt(p.name, 0, "unknown profile %q, expected one of: %s", opts.Profile, jc.Profile)
+	}
+
+	for i, jb := range jc.Blocks {
+		p.loadJSONBlock(fmt.Sprintf("blocks[%d]", i), jb)
+	}
+	if p.failed() {
+		return
+	}
+
+	for k, v := range opts.Variables {
+		c.override(k, v, position{"command line", 0})
+	}
+	if _, err := resolveAll(c.variables, nil); err != nil {
+		p.variableError(err)
+	}
+	p.expandBlocks()
+}
+
+func (p *parser) loadJSONBlock(where string, jb JSONBlock) {
+	b := Block{
+		Include:         jb.Include,
+		Exclude:         jb.Exclude,
+		NoCommonFilter:  jb.NoIgnore,
+		Strict:          jb.Strict,
+		Concurrent:      jb.Concurrent,
+		RestartOnChange: jb.RestartOnChange,
+		InDir:           jb.InDir,
+		Name:            jb.Name,
+		Source:          p.name,
+	}
+	if len(b.Include) == 0 {
+		b.Include = nil
+	}
+	if len(b.Exclude) == 0 {
+		b.Exclude = nil
+	}
+	for _, k := range sortedKeys(jb.Variables) {
+		if !jsonVarName.MatchString(k) {
+			p.reportJSON(where+".variables", fmt.Errorf("invalid variable name %q", k))
+			continue
+		}
+		if err := b.addVariable(k, jb.Variables[k]); err != nil {
+			p.reportJSON(where+".variables", err)
+		}
+	}
+	if _, err := resolveAll(b.Variables, nil); err != nil {
+		p.reportJSON(where+".variables", err)
+	}
+	for i, jp := range jb.Preps {
+		var options []string
+		if jp.Onchange {
+			options = append(options, "+onchange")
+		}
+		if jp.AllowFail {
+			options = append(options, "+allowfail")
+		}
+		if jp.Always {
+			options = append(options, "+always")
+		}
+		if jp.Parallel {
+			options = append(options, "+parallel")
+		}
+		if jp.Timeout != "" {
+			options = append(options, "+timeout="+jp.Timeout)
+		}
+		if jp.Retry != 0 || jp.Backoff != "" {
+			retry := fmt.Sprintf("+retry=%d", jp.Retry)
+			if jp.Backoff != "" {
+				retry += ",backoff=" + jp.Backoff
+			}
+			options = append(options, retry)
+		}
+		if err := b.addPrep(jp.Command, options); err != nil {
+			p.reportJSON(fmt.Sprintf("%s.preps[%d]", where, i), err)
+		}
+	}
+	for i, jd := range jb.Daemons {
+		var options []string
+		if jd.Signal != "" {
+			options = append(options, "+"+jd.Signal)
+		}
+		for _, from := range sortedKeys(jd.SignalMap) {
+			options = append(options, "+"+from+"->"+jd.SignalMap[from])
+		}
+		if err := b.addDaemon(jd.Command, options); err != nil {
+			p.reportJSON(fmt.Sprintf("%s.daemons[%d]", where, i), err)
+		}
+	}
+	if err := p.config.addBlock(b); err != nil {
+		p.reportJSON(where, err)
+	}
+}
+
+// escapeAll escapes the variable references in patterns that are already
+// expanded, since they are expanded again when the JSON is read
+func escapeAll(pats []string) []string {
+	ret := make([]string, len(pats))
+	for i, pat := range pats {
+		ret[i] = escape(pat)
+	}
+	return ret
+}
+
+// durationString formats a duration for JSON, or returns an empty string for
+// zero
+func durationString(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return d.String()
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,135 @@
+package conf
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+// Configs whose patterns and values only round trip if the JSON form escapes
+// them
+var jsonEscapeTests = []string{
+	"src/** !node_modules/\\@types/** {}",
+	"@a = \\@b\n@b = x\nfoo {\nindir: \\\\\\@a\n@c = x/\\@d\nprep: @c\n}",
+	"@mail = me\\@env.HOME:-x\n@mail/** {}",
+}
+
+// Reading back the JSON form of a config gives the same blocks and variables
+func TestJSONRoundTrip(t *testing.T) {
+	var inputs []struct{ path, input string }
+	for _, tt := range parseTests {
+		inputs = append(inputs, struct{ path, input string }{tt.path, tt.input})
+	}
+	for _, input := range jsonEscapeTests {
+		inputs = append(inputs, struct{ path, input string }{"", input})
+	}
+	// Common excludes are written with the others, and aren't added again
+	excludes := []string{"**/.git/**"}
+	for i, tt := range inputs {
+		cnf, err := Parse(tt.path, tt.input)
+		if err != nil {
+			t.Fatalf("%d: %q - %s", i, tt.input, err)
+		}
+		cnf.CommonExcludes(excludes)
+		data, err := json.Marshal(cnf.JSON())
+		if err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+		ret, err := ParseJSON(tt.path, data, Options{})
+		if err != nil {
+			t.Fatalf("%d: %s - %s", i, data, err)
+		}
+		ret.CommonExcludes(excludes)
+		if diff := cmp.Diff(cnf.GetVariables(), ret.GetVariables()); diff != "" {
+			t.Errorf("%d: %s\n%s", i, data, diff)
+		}
+		opts := append(parseCmpOptions, cmpopts.IgnoreFields(Block{}, "Source"), cmpopts.EquateEmpty())
+		if diff := cmp.Diff(cnf.Blocks, ret.Blocks, opts...); diff != "" {
+			t.Errorf("%d: %s\n%s", i, data, diff)
+		}
+	}
+}
+
+func TestParseJSON(t *testing.T) {
+	data := `{
+		"variables": {"@dir": "src", "@bin": "@dir/bin"},
+		"blocks": [
+			{
+				"name": "web",
+				"include": ["@dir/**"],
+				"variables": {"@port": "80"},
+				"preps": [{"command": "go build -o @bin", "onchange": true}],
+				"daemons": [{"command": "@bin -p @port", "rendered": "ignored", "signal": "sigterm"}]
+			},
+			{"include": []}
+		]
+	}`
+	ret, err := ParseJSON("ppow.json", []byte(data), Options{Variables: map[string]string{"@dir": "lib"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"@confdir": ".", "@dir": "lib", "@bin": "lib/bin"}
+	if diff := cmp.Diff(expected, ret.GetVariables()); diff != "" {
+		t.Error(diff)
+	}
+	if len(ret.Blocks) != 2 {
+		t.Fatalf("Expected 2 blocks, got %d", len(ret.Blocks))
+	}
+	b := ret.Blocks[0]
+	if diff := cmp.Diff([]string{"lib/**"}, b.Include); diff != "" {
+		t.Error(diff)
+	}
+	if diff := cmp.Diff([]Prep{{Command: "go build -o @bin", Onchange: true}}, b.Preps); diff != "" {
+		t.Error(diff)
+	}
+	if b.Daemons[0].Command != "@bin -p @port" || signalName(b.Daemons[0].RestartSignal) != "sigterm" {
+		t.Errorf("Unexpected daemon: %+v", b.Daemons[0])
+	}
+	if b.Source != "ppow.json" || b.Name != "web" || b.Variables["@port"] != "80" {
+		t.Errorf("Unexpected block: %+v", b)
+	}
+}
+
+var parseJSONErrorTests = []struct {
+	input    string
+	expected string
+}{
+	{"{\n  \"blocks\": [\n    {,\n", "test.json:3:6: invalid character ',' looking for beginning of object key string"},
+	{`{"blocks": {}}`, "test.json:1:12: json: cannot unmarshal object into Go struct field JSONConfig.blocks of type []conf.JSONBlock"},
+	{`{"blocks": [{"patterns": []}]}`, `test.json: json: unknown field "patterns"`},
+	{`{"variables": {"dir": "x"}}`, `test.json: variables: invalid variable name "dir"`},
+	{
+		`{"blocks": [{"preps": [{"command": "a", "onchange": true}]}, {"name": "x"}, {"name": "x", "preps": [{"command": "b"}]}]}`,
+		"test.json: blocks[2]: duplicate block name: x",
+	},
+	{
+		`{"blocks": [{"daemons": [{"command": "a", "signal": "sigtrem"}]}]}`,
+		"test.json: blocks[0].daemons[0]: unknown signal: sigtrem (did you mean sigterm?)",
+	},
+	{
+		`{"blocks": [{"variables": {"@a": "@b", "@b": "@a"}}]}`,
+		"test.json: blocks[0].variables: variable cycle: @a -> @b -> @a",
+	},
+	{`{"variables": {"@a": "@b", "@b": "@a"}}`, "test.json: variable cycle: @a -> @b -> @a"},
+	{`{"blocks": [{"include": ["@nope/**"]}]}`, `test.json: unknown variable @nope in pattern "@nope/**"`},
+}
+
+func TestParseJSONErrors(t *testing.T) {
+	for _, tt := range parseJSONErrorTests {
+		_, err := ParseJSON("test.json", []byte(tt.input), Options{})
+		if err == nil {
+			t.Errorf("%s: expected an error", tt.input)
+			continue
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("%s: expected\n%q\ngot\n%q", tt.input, tt.expected, err.Error())
+		}
+	}
+	_, err := ParseJSON("test.json", []byte(`{"profile": "ci"}`), Options{Profile: "dev"})
+	expected := `test.json: unknown profile "dev", expected one of: ci`
+	if err == nil || err.Error() != expected {
+		t.Errorf("Expected %q, got %v", expected, err)
+	}
+}
@@ -31,13 +31,17 @@ const (
 	itemError // error occurred; value is text of error
 	itemEOF
 	itemInDir
+	itemInclude
 	itemLeftParen
+	itemName
 	itemQuotedString
 	itemPrep
+	itemProfile
 	itemRightParen
 	itemSpace
 	itemVarName
 	itemEquals
+	itemDefaultEquals
 )
 
 func (i itemType) String() string {
@@ -54,14 +58,22 @@ func (i itemType) String() string {
 		return "error"
 	case itemEquals:
 		return "="
+	case itemDefaultEquals:
+		return "?="
 	case itemEOF:
 		return "eof"
 	case itemInDir:
 		return "indir"
+	case itemInclude:
+		return "include"
 	case itemLeftParen:
 		return "lparen"
+	case itemName:
+		return "name"
 	case itemPrep:
 		return "prep"
+	case itemProfile:
+		return "profile"
 	case itemQuotedString:
 		return "quotedstring"
 	case itemRightParen:
@@ -89,18 +101,29 @@ type item struct {
 	typ itemType // The type of this item.
 	pos Pos      // The starting position, in bytes, of this item in the input string.
 	val string   // The value of this item.
+
+	// For errors, the input the error was found at, and a suggestion for
+	// fixing it
+	token string
+	hint  string
 }
 
 // lexer holds the state of the scanner.
 type lexer struct {
-	name    string    // the name of the input; used only for error reports
-	input   string    // the string being scanned
-	state   stateFn   // the next lexing function to enter
-	pos     Pos       // current position in the input
-	start   Pos       // start position of this item
-	width   Pos       // width of last rune read from input
-	lastPos Pos       // position of most recent item returned by nextItem
-	items   chan item // channel of scanned items
+	name  string    // the name of the input; used only for error reports
+	input string    // the string being scanned
+	state stateFn   // the next lexing function to enter
+	pos   Pos       // current position in the input
+	start Pos       // start position of this item
+	width Pos       // width of last rune read from input
+	items chan item // channel of scanned items
+	// How many profile sections we're inside. A } ends the innermost one.
+	// The parser rejects nested sections, but the lexer tracks them so that
+	// it stays in step.
+	profileDepth int
+	// Whether we're inside a block, and where the block started
+	inBlock    bool
+	blockStart Pos
 }
 
 func (l *lexer) current() string {
@@ -133,7 +156,7 @@ func (l *lexer) backup() {
 
 // emit passes an item back to the client.
 func (l *lexer) emit(t itemType) {
-	l.items <- item{t, l.start, l.current()}
+	l.items <- item{typ: t, pos: l.start, val: l.current()}
 	l.start = l.pos
 }
 
@@ -196,25 +219,61 @@ func (l *lexer) eatSpaceAndComments() rune {
 	}
 }
 
-// lineNumber reports which line we're on, based on the position of
-// the previous item returned by nextItem. Doing it this way
-// means we don't have to worry about peek double counting.
-func (l *lexer) lineNumber() int {
-	return 1 + strings.Count(l.input[:l.lastPos], "\n")
+// errorf emits an error token, and returns the state that skips past the
+// error and resumes scanning.
+func (l *lexer) errorf(format string, args ...interface{}) stateFn {
+	return l.hintf("", format, args...)
 }
 
-// errorf returns an error token and terminates the scan by passing
-// back a nil pointer that will be the next state, terminating l.nextItem.
-func (l *lexer) errorf(format string, args ...interface{}) stateFn {
-	l.items <- item{itemError, l.start, fmt.Sprintf(format, args...)}
-	return nil
+// hintf is like errorf, with a suggestion for fixing the error
+func (l *lexer) hintf(hint string, format string, args ...interface{}) stateFn {
+	l.items <- item{
+		typ:   itemError,
+		pos:   l.start,
+		val:   fmt.Sprintf(format, args...),
+		token: l.current(),
+		hint:  hint,
+	}
+	return lexResync
+}
+
+// lexResync skips the rest of the line after an error, and resumes scanning in
+// the block or at the top level, so that later errors can be reported too.
+func lexResync(l *lexer) stateFn {
+	from := l.pos
+	// Skip the rest of the line, unless the error was at its end
+	if from == 0 || l.input[from-1] != '\n' {
+		l.acceptLine(false)
+	}
+	rest := strings.TrimRight(l.input[from:l.pos], whitespace)
+	if !l.inBlock && strings.Contains(rest, "{") {
+		// The error was in the patterns of a block, so carry on with its body
+		l.inBlock = true
+		l.blockStart = from
+	}
+	if l.inBlock && strings.HasSuffix(rest, "}") {
+		// Leave the closing brace of a one-line block
+		l.pos = from + Pos(len(rest)-1)
+	}
+	l.ignore()
+	if l.peek() == eof {
+		// Errors that run to the end of the input, like unterminated quoted
+		// strings, already explain a missing }
+		if l.inBlock && from < Pos(len(l.input)) {
+			return l.unterminatedBlock()
+		}
+		l.emit(itemEOF)
+		return nil
+	}
+	if l.inBlock {
+		return lexInside
+	}
+	return lexTop
 }
 
 // nextItem returns the next item from the input.
 func (l *lexer) nextItem() item {
-	item := <-l.items
-	l.lastPos = item.pos
-	return item
+	return <-l.items
 }
 
 // nextSignificantItem returns the next significant item from the input,
@@ -279,6 +338,40 @@ func (l *lexer) acceptLine(permitEscaping bool) {
 	}
 }
 
+// atKeyword checks whether the input at the current position is the keyword
+// kw, followed by a space or a quote
+func (l *lexer) atKeyword(kw string) bool {
+	rest := l.input[l.pos:]
+	if !strings.HasPrefix(rest, kw) || len(rest) == len(kw) {
+		return false
+	}
+	return any(rune(rest[len(kw)]), spaces+quotes)
+}
+
+// atDeclaration checks whether the input at the current position, just after
+// an @, is a variable declaration: a name, optionally followed by options, and
+// then = or ?=. Otherwise the @ starts a pattern with a variable reference.
+func (l *lexer) atDeclaration() bool {
+	rest := l.input[l.pos:]
+	skipWord := func() {
+		i := strings.IndexFunc(rest, func(r rune) bool { return !any(r, wordRunes) })
+		if i < 0 {
+			i = len(rest)
+		}
+		rest = rest[i:]
+	}
+	skipWord()
+	for {
+		rest = strings.TrimLeft(rest, whitespace)
+		if !strings.HasPrefix(rest, "+") {
+			break
+		}
+		rest = rest[1:]
+		skipWord()
+	}
+	return strings.HasPrefix(rest, "=") || strings.HasPrefix(rest, "?=")
+}
+
 // acceptBareString accepts a bare, unquoted string
 func (l *lexer) acceptBareString() {
 	l.acceptFunc(
@@ -297,11 +390,12 @@ func (l *lexer) acceptWord() {
 	)
 }
 
-// acceptWord accepts a lowercase word
-func (l *lexer) acceptWordOrArrow() {
+// acceptOption accepts the body of a command option, like sigterm->sigusr1 or
+// os=linux,darwin
+func (l *lexer) acceptOption() {
 	l.acceptFunc(
 		func(r rune) bool {
-			return any(r, wordRunes) || r == '-' || r == '>'
+			return any(r, wordRunes+"->=,.@!")
 		},
 	)
 }
@@ -344,22 +438,19 @@ func lexPatterns(l *lexer) stateFn {
 			if any(pk, quotes) {
 				err := l.acceptQuotedString(pk)
 				if err != nil {
-					l.errorf("%s", err)
-					return nil
+					return l.errorf("%s", err)
 				}
 				l.emit(itemQuotedString)
 			} else if !any(pk, bareStringDisallowed) {
 				l.acceptBareString()
 				l.emit(itemBareString)
 			} else {
-				l.errorf("! must be followed by a string")
-				return nil
+				return l.errorf("! must be followed by a string")
 			}
 		} else if any(n, quotes) {
 			err := l.acceptQuotedString(n)
 			if err != nil {
-				l.errorf("%s", err)
-				return nil
+				return l.errorf("%s", err)
 			}
 			l.emit(itemQuotedString)
 		} else if !any(n, bareStringDisallowed) {
@@ -372,51 +463,137 @@ func lexPatterns(l *lexer) stateFn {
 	}
 }
 
+// lexVariable lexes a variable declaration, after the leading @ has been
+// consumed. It returns false if an error was emitted.
+func lexVariable(l *lexer) bool {
+	l.acceptWord()
+	l.emit(itemVarName)
+	n := l.maybeSpace()
+	for n == '+' {
+		l.acceptWord()
+		l.emit(itemBareString)
+		n = l.maybeSpace()
+	}
+	if n == '=' {
+		l.emit(itemEquals)
+	} else if n == '?' && l.peek() == '=' {
+		l.next()
+		l.emit(itemDefaultEquals)
+	}
+	n = l.maybeSpace()
+	if n == eof {
+		l.errorf("unterminated variable assignment")
+		return false
+	} else if any(n, quotes) {
+		err := l.acceptQuotedString(n)
+		if err != nil {
+			l.errorf("%s", err)
+			return false
+		}
+		l.emit(itemQuotedString)
+	} else if !any(n, bareStringDisallowed) {
+		l.acceptLine(true)
+		l.emit(itemBareString)
+	} else {
+		l.errorf("= must be followed by a string")
+		return false
+	}
+	return true
+}
+
 // lexVariables reads a block of variable declarations.
 func lexVariables(l *lexer) stateFn {
 	for {
 		n := l.eatSpaceAndComments()
-		if n == '@' {
-			l.acceptWord()
-			l.emit(itemVarName)
-			n = l.maybeSpace()
-			if n == '=' {
-				l.emit(itemEquals)
-			}
-			n = l.maybeSpace()
-			if n == eof {
-				l.errorf("unterminated variable assignment")
-				return nil
-			} else if any(n, quotes) {
-				err := l.acceptQuotedString(n)
-				if err != nil {
-					l.errorf("%s", err)
-					return nil
-				}
-				l.emit(itemQuotedString)
-			} else if !any(n, bareStringDisallowed) {
-				l.acceptLine(true)
-				l.emit(itemBareString)
-			} else {
-				l.errorf("= must be followed by a string")
-				return nil
+		if n == '@' && l.atDeclaration() {
+			if !lexVariable(l) {
+				return lexResync
 			}
+		} else if n == '}' && l.profileDepth > 0 {
+			l.emit(itemRightParen)
+			l.profileDepth--
 		} else {
 			l.backup()
+			if l.atKeyword("include") {
+				return lexInclude
+			}
+			if l.atKeyword("profile") {
+				return lexProfile
+			}
 			return lexPatterns
 		}
 	}
 }
 
+// lexInclude lexes an include statement and the path that follows it. The path
+// must be on the same line as the keyword.
+func lexInclude(l *lexer) stateFn {
+	l.pos += Pos(len("include"))
+	l.emit(itemInclude)
+	for {
+		n := l.next()
+		if any(n, spaces) {
+			l.acceptRun(spaces)
+			l.emit(itemSpace)
+		} else if any(n, quotes) {
+			err := l.acceptQuotedString(n)
+			if err != nil {
+				return l.errorf("%s", err)
+			}
+			l.emit(itemQuotedString)
+			return lexVariables
+		} else if !any(n, bareStringDisallowed) {
+			l.acceptBareString()
+			l.emit(itemBareString)
+			return lexVariables
+		} else {
+			return l.errorf("include must be followed by a path")
+		}
+	}
+}
+
+// lexProfile lexes the start of a profile section: the keyword, the name and
+// options of the profile, and the opening brace.
+func lexProfile(l *lexer) stateFn {
+	l.pos += Pos(len("profile"))
+	l.emit(itemProfile)
+	for {
+		n := l.next()
+		if any(n, spaces) {
+			l.acceptRun(spaces)
+			l.emit(itemSpace)
+		} else if n == '{' {
+			l.emit(itemLeftParen)
+			l.profileDepth++
+			return lexVariables
+		} else if n == '+' {
+			l.acceptOption()
+			l.emit(itemBareString)
+		} else if any(n, wordRunes+"-") {
+			l.acceptFunc(func(r rune) bool { return any(r, wordRunes+"-") })
+			l.emit(itemBareString)
+		} else {
+			return l.errorf("profile must be followed by a name and {")
+		}
+	}
+}
+
 func lexTop(l *lexer) stateFn {
 	return lexVariables
 }
 
+// Directives lists the directives that can be used inside a block
+var Directives = []string{"daemon", "indir", "name", "prep"}
+
 func lexBlockStart(l *lexer) stateFn {
 	n := l.next()
 	if n == '{' {
+		l.inBlock = true
+		l.blockStart = l.start
 		l.emit(itemLeftParen)
 		return lexInside
+	} else if n == '}' {
+		return l.hintf("remove it, or add the { it should close", "unexpected }")
 	}
 	return l.errorf("invalid input")
 }
@@ -425,10 +602,17 @@ func lexInside(l *lexer) stateFn {
 	for {
 		n := l.eatSpaceAndComments()
 		if n == '}' {
+			l.inBlock = false
 			l.emit(itemRightParen)
 			return lexTop
 		} else if n == eof {
-			return l.errorf("unterminated block")
+			return l.unterminatedBlock()
+		} else if n == '{' {
+			return l.hintf("blocks can't be nested; is a } missing?", "unexpected {")
+		} else if n == '@' {
+			if !lexVariable(l) {
+				return lexResync
+			}
 		} else if !any(n, bareStringDisallowed) {
 			l.acceptWord()
 			switch l.current() {
@@ -438,12 +622,17 @@ func lexInside(l *lexer) stateFn {
 			case "indir":
 				l.emit(itemInDir)
 				return lexOptions
+			case "name":
+				l.emit(itemName)
+				return lexOptions
 			case "prep":
 				l.emit(itemPrep)
 				return lexOptions
 			default:
-				l.errorf("unknown directive: %s", l.current())
-				return nil
+				return l.hintf(
+					didYouMean(l.current(), Directives),
+					"unknown directive: %s", l.current(),
+				)
 			}
 		} else {
 			return l.errorf("invalid input")
@@ -462,28 +651,42 @@ func lexOptions(l *lexer) stateFn {
 			l.emit(itemColon)
 			return lexCommand
 		} else if n == '+' {
-			l.acceptWordOrArrow()
+			l.acceptOption()
 			l.emit(itemBareString)
+		} else if n == eof {
+			return l.unterminatedBlock()
+		} else if any(n, wordRunes) {
+			l.backup()
+			return l.hintf("put a colon between the directive and its value", "expected :")
 		} else {
-			l.errorf("invalid command option")
-			return nil
+			return l.errorf("invalid command option")
 		}
 	}
 }
 
+// unterminatedBlock reports a block that is still open at the end of the
+// input
+func (l *lexer) unterminatedBlock() stateFn {
+	l.inBlock = false
+	line, _ := lineCol(l.input, l.blockStart)
+	hint := fmt.Sprintf("the block opened on line %d needs a closing }", line)
+	if strings.HasSuffix(strings.TrimSpace(l.input[:l.pos]), "}") {
+		hint = "a } at the end of a command is part of the command; put it on a line of its own"
+	}
+	return l.hintf(hint, "unterminated block")
+}
+
 // lexCommand lexes a single command. Commands can either be unquoted and on a
 // single line, or quoted and span multiple lines.
 func lexCommand(l *lexer) stateFn {
 	for {
 		n := l.next()
 		if n == '\n' {
-			l.errorf("empty command specification")
-			return nil
+			return l.errorf("empty command specification")
 		} else if any(n, quotes) {
 			err := l.acceptQuotedString(n)
 			if err != nil {
-				l.errorf("%s", err)
-				return nil
+				return l.errorf("%s", err)
 			}
 			l.emit(itemQuotedString)
 			return lexInside
@@ -256,6 +256,79 @@ var lexTests = []struct {
 			{itemRightParen, "}"},
 		},
 	},
+	{
+		"{\nname: foo\n}\n", []itm{
+			{itemLeftParen, "{"},
+			{itemName, "name"},
+			{itemColon, ":"},
+			{itemBareString, "foo\n"},
+			{itemRightParen, "}"},
+		},
+	},
+	{
+		"{\n@a = b\nprep: @a\n}\n", []itm{
+			{itemLeftParen, "{"},
+			{itemVarName, "@a"},
+			{itemEquals, "="},
+			{itemBareString, "b\n"},
+			{itemPrep, "prep"},
+			{itemColon, ":"},
+			{itemBareString, "@a\n"},
+			{itemRightParen, "}"},
+		},
+	},
+	{
+		"@a = b\n@env.SRC/** {}", []itm{
+			{itemVarName, "@a"},
+			{itemEquals, "="},
+			{itemBareString, "b\n"},
+			{itemBareString, "@env.SRC/**"},
+			{itemLeftParen, "{"},
+			{itemRightParen, "}"},
+		},
+	},
+	{
+		"a +os=linux,darwin {\nprep +if=!@ci: foo\n}", []itm{
+			{itemBareString, "a"},
+			{itemBareString, "+os=linux,darwin"},
+			{itemLeftParen, "{"},
+			{itemPrep, "prep"},
+			{itemBareString, "+if=!@ci"},
+			{itemColon, ":"},
+			{itemBareString, "foo\n"},
+			{itemRightParen, "}"},
+		},
+	},
+	{
+		"profile ci +default {\n@a = b\nfoo {}\n}", []itm{
+			{itemProfile, "profile"},
+			{itemBareString, "ci"},
+			{itemBareString, "+default"},
+			{itemLeftParen, "{"},
+			{itemVarName, "@a"},
+			{itemEquals, "="},
+			{itemBareString, "b\n"},
+			{itemBareString, "foo"},
+			{itemLeftParen, "{"},
+			{itemRightParen, "}"},
+			{itemRightParen, "}"},
+		},
+	},
+	{
+		"@a ?= b", []itm{
+			{itemVarName, "@a"},
+			{itemDefaultEquals, "?="},
+			{itemBareString, "b"},
+		},
+	},
+	{
+		"@a +ontrigger = $(date)", []itm{
+			{itemVarName, "@a"},
+			{itemBareString, "+ontrigger"},
+			{itemEquals, "="},
+			{itemBareString, "$(date)"},
+		},
+	},
 	{
 		"@W = b", []itm{
 			{itemVarName, "@W"},
@@ -263,6 +336,24 @@ var lexTests = []struct {
 			{itemBareString, "b"},
 		},
 	},
+	{
+		"include foo.conf\ninclude 'bar baz.conf'\none {}", []itm{
+			{itemInclude, "include"},
+			{itemBareString, "foo.conf"},
+			{itemInclude, "include"},
+			{itemQuotedString, "'bar baz.conf'"},
+			{itemBareString, "one"},
+			{itemLeftParen, "{"},
+			{itemRightParen, "}"},
+		},
+	},
+	{
+		"includes {}", []itm{
+			{itemBareString, "includes"},
+			{itemLeftParen, "{"},
+			{itemRightParen, "}"},
+		},
+	},
 }
 
 func TestLex(t *testing.T) {
@@ -282,9 +373,9 @@ var lexErrorTests = []struct {
 	{"'", "unterminated quoted string", 1},
 	{"'\\", "unterminated quoted string", 2},
 	{"  '\nfoo", "unterminated quoted string", 7},
-	{"foo }", "invalid input", 5},
+	{"foo }", "unexpected }", 5},
 	{"{", "unterminated block", 1},
-	{"{{}", "invalid input", 2},
+	{"{{}", "unexpected {", 2},
 	{"{daemon: '}", "unterminated quoted string", 11},
 	{"{#}", "unterminated block", 3},
 	{"!'", "unterminated quoted string", 2},
@@ -294,21 +385,24 @@ var lexErrorTests = []struct {
 	{"@foo = \n}", "= must be followed by a string", 9},
 	{"@foo =", "unterminated variable assignment", 6},
 	{"@foo = '", "unterminated quoted string", 8},
+	{"include {}", "include must be followed by a path", 9},
 }
 
 func TestLexErrors(t *testing.T) {
 	for i, tt := range lexErrorTests {
 		l := lex("test", tt.input)
-		ret := lexcollect(l)
-		itm := ret[len(ret)-1]
+		itm := l.nextItem()
+		for itm.typ != itemError && itm.typ != itemEOF {
+			itm = l.nextItem()
+		}
 		if itm.typ != itemError {
-			t.Errorf("%d: %q - Expected error, got %s", i, tt.input, itm)
+			t.Errorf("%d: %q - Expected error, got %s %q", i, tt.input, itm.typ, itm.val)
 		}
 		if itm.val != tt.error {
 			t.Errorf("%d: %q - Expected error value\n%s\ngot\n%s", i, tt.input, tt.error, itm.val)
 		}
-		if tt.pos != l.pos {
-			t.Errorf("%d: %q - Expected position %d, got %d", i, tt.input, tt.pos, l.pos)
+		if end := itm.pos + Pos(len(itm.token)); tt.pos != end {
+			t.Errorf("%d: %q - Expected position %d, got %d", i, tt.input, tt.pos, end)
 		}
 	}
 }
@@ -8,13 +8,14 @@ package conf
 
 import (
 	"fmt"
+	"os"
 	"path"
 	"path/filepath"
-	"runtime"
 	"strings"
 )
 
 const confVarName = "@confdir"
+const shellVarName = "@shell"
 
 type parser struct {
 	name   string
@@ -22,9 +23,32 @@ type parser struct {
 	lex    *lexer
 	config *Config
 
+	// The chain of files that led to this one being included, starting with
+	// the top-level config. Used to detect include cycles.
+	chain []string
+	// Set when parsing a local override file
+	override bool
+	// The profile section being parsed, if any. Files included from a
+	// profile section belong to the profile as well.
+	profile string
+	// Set while parsing the body of a profile section in this file, which
+	// has to end with a closing brace
+	section bool
+	// The directory patterns and indir are relative to, or empty for the
+	// current directory
+	root string
+
+	// Problems found so far, shared by the parsers of all files
+	diagnostics *[]Diagnostic
+	// The last token returned by next
+	token    item
 	peekItem *item
 }
 
+// bailout is the panic value that abandons the current parsing step, once
+// the problem has been recorded
+type bailout struct{}
+
 // Dreadfully naive at the moment, but then so is the lexer.
 func unquote(s string) string {
 	quote := s[0:1]
@@ -33,16 +57,27 @@ func unquote(s string) string {
 	return s
 }
 
-// next returns the next token.
+// next returns the next token. Errors from the lexer abandon the current
+// parsing step.
 func (p *parser) next() item {
-	if p.peekItem != nil {
-		itm := *p.peekItem
+	nxt := p.skip()
+	if nxt.typ == itemError {
+		panic(bailout{})
+	}
+	return nxt
+}
+
+// skip consumes the next token. Errors from the lexer are recorded, but don't
+// abandon the current parsing step.
+func (p *parser) skip() item {
+	nxt := p.peek()
+	// EOF stays put, so that every parsing step sees the end of the input
+	if nxt.typ != itemEOF {
 		p.peekItem = nil
-		return itm
 	}
-	nxt := p.lex.nextSignificantItem()
+	p.token = nxt
 	if nxt.typ == itemError {
-		p.errorf("%s", nxt.val)
+		p.report(nxt, nxt.hint, "%s", nxt.val)
 	}
 	return nxt
 }
@@ -59,7 +94,11 @@ func anyType(t itemType, allowed []itemType) bool {
 func (p *parser) mustNext(allowed ...itemType) item {
 	nxt := p.next()
 	if !anyType(nxt.typ, allowed) {
-		p.errorf("invalid syntax")
+		names := make([]string, len(allowed))
+		for i, t := range allowed {
+			names[i] = t.String()
+		}
+		p.errorf("invalid syntax: expected %s, got %s", strings.Join(names, " or "), nxt.typ)
 	}
 	return nxt
 }
@@ -87,7 +126,11 @@ func (p *parser) collect(types ...itemType) []item {
 }
 
 func (p *parser) collectValues(types ...itemType) []string {
-	items := p.collect(types...)
+	return values(p.collect(types...))
+}
+
+// values returns the values of a list of items
+func values(items []item) []string {
 	ret := make([]string, len(items))
 	for i, v := range items {
 		ret[i] = v.val
@@ -96,9 +139,10 @@ func (p *parser) collectValues(types ...itemType) []string {
 }
 
 // Collects an arbitrary number of patterns, and returns a (watch, exclude,
-// NoCommonFilter) tuple.
-func (p *parser) collectPatterns() ([]string, []string, bool) {
-	noCommonFilter := false
+// flags) tuple. Flags are the block options that may be mixed in with the
+// patterns, like +noignore.
+func (p *parser) collectPatterns() ([]string, []string, []string) {
+	flags := []string{}
 	watch := []string{}
 	exclude := []string{}
 
@@ -109,8 +153,8 @@ func (p *parser) collectPatterns() ([]string, []string, bool) {
 			if v.val[0] == '!' {
 				exclude = append(exclude, v.val[1:])
 			} else {
-				if v.val == "+noignore" {
-					noCommonFilter = true
+				if blockFlags[v.val] || isCondition(v.val) {
+					flags = append(flags, v.val)
 				} else {
 					watch = append(watch, v.val)
 				}
@@ -129,90 +173,438 @@ func (p *parser) collectPatterns() ([]string, []string, bool) {
 	if len(exclude) == 0 {
 		exclude = nil
 	}
-	return watch, exclude, noCommonFilter
+	return watch, exclude, flags
 }
 
-// errorf formats the error and terminates processing.
+// Block options that can be given among the patterns
+var blockFlags = map[string]bool{
+	"+concurrent":        true,
+	"+disable":           true,
+	"+noignore":          true,
+	"+restart-on-change": true,
+	"+strict":            true,
+}
+
+// BlockOptions lists the options that can be given among the patterns of a
+// block. Conditions are listed as prefixes, like +os=.
+var BlockOptions = append([]string{"+concurrent", "+disable", "+noignore", "+restart-on-change", "+strict"}, conditionPrefixes...)
+
+// report records a problem at the position of an item
+func (p *parser) report(itm item, hint string, format string, args ...interface{}) {
+	d := newDiagnostic(p.name, p.lex.input, itm, hint, fmt.Sprintf(format, args...))
+	*p.diagnostics = append(*p.diagnostics, d)
+}
+
+// reportf records a problem at the current token. Parsing carries on.
+func (p *parser) reportf(format string, args ...interface{}) {
+	p.report(p.token, "", format, args...)
+}
+
+// fail records a problem at an item, and abandons the current parsing step
+func (p *parser) fail(itm item, hint string, format string, args ...interface{}) {
+	p.report(itm, hint, format, args...)
+	panic(bailout{})
+}
+
+// errorf records a problem at the current token, and abandons the current
+// parsing step.
 func (p *parser) errorf(format string, args ...interface{}) {
-	p.config = nil
-	format = fmt.Sprintf("%s:%d: %s", p.name, p.lex.lineNumber(), format)
-	panic(fmt.Errorf(format, args...))
+	p.fail(p.token, "", format, args...)
 }
 
-func (p *parser) stopParse() {
-	p.lex = nil
+// reportAt records a problem that concerns a whole line, or a whole file if
+// line is 0.
+func (p *parser) reportAt(file string, line int, format string, args ...interface{}) {
+	*p.diagnostics = append(*p.diagnostics, Diagnostic{
+		File:    file,
+		Line:    line,
+		Message: fmt.Sprintf(format, args...),
+	})
 }
 
-// recover is the handler that turns panics into returns from the top level of
-// Parse.
-func (p *parser) recover(errp *error) {
-	e := recover()
-	if e != nil {
-		if _, ok := e.(runtime.Error); ok {
-			panic(e)
-		}
-		if p != nil {
-			p.stopParse()
+// errorAt is like reportAt, but abandons the current parsing step.
+func (p *parser) errorAt(file string, line int, format string, args ...interface{}) {
+	p.reportAt(file, line, format, args...)
+	panic(bailout{})
+}
+
+// try runs a parsing step, and reports whether it completed
+func (p *parser) try(step func()) (ok bool) {
+	defer func() {
+		if e := recover(); e != nil {
+			if _, isBailout := e.(bailout); !isBailout {
+				panic(e)
+			}
+			ok = false
 		}
-		*errp = e.(error)
+	}()
+	step()
+	return true
+}
+
+// failed checks whether any problems have been found
+func (p *parser) failed() bool {
+	return len(*p.diagnostics) > 0
+}
+
+func (p *parser) parse(opts Options) error {
+	p.diagnostics = &[]Diagnostic{}
+	p.try(func() { p.parseConfig(opts) })
+	if p.failed() {
+		return &ParseError{*p.diagnostics}
 	}
-	return
+	return nil
 }
 
-func (p *parser) parse() (err error) {
-	defer p.recover(&err)
-	p.lex = lex(p.name, p.text)
+// parseConfig parses the main config and the local override file, and then
+// resolves variables, conditions and patterns if there were no syntax
+// errors.
+func (p *parser) parseConfig(opts Options) {
 	p.config = &Config{}
+	p.chain = []string{p.name}
+	p.setRoot(opts.Root)
 
 	// Store path to conf in variable if not empty
 	if p.name != "" {
-		p.config.addVariable(confVarName, path.Dir(p.name))
+		p.config.addVariable(confVarName, p.confDir(), nil, position{p.name, 0})
 	}
 
+	p.parseFile()
+	if p.failed() {
+		return
+	}
+	p.selectProfile(opts.Profile, opts.ProfileFallback)
+
+	if opts.Local != "" {
+		text, err := os.ReadFile(opts.Local)
+		if err == nil {
+			local := &parser{
+				name:        opts.Local,
+				text:        string(text),
+				config:      p.config,
+				chain:       []string{opts.Local},
+				override:    true,
+				diagnostics: p.diagnostics,
+			}
+			local.parseFile()
+			if p.failed() {
+				return
+			}
+		} else if !os.IsNotExist(err) {
+			p.errorAt(opts.Local, 0, "%s", err)
+		}
+	}
+
+	for k, v := range opts.Variables {
+		p.config.override(k, v, position{"command line", 0})
+	}
+
+	if _, err := resolveAll(p.config.variables, nil); err != nil {
+		p.variableError(err)
+	}
+
+	if opts.Eval != nil {
+		p.config.root = p.root
+		if err := p.config.evalCommands(opts.Eval); err != nil {
+			p.variableError(err)
+		}
+	}
+	p.applyConditions()
+	p.expandBlocks()
+}
+
+// variableError reports an error from resolving the global variables at the
+// declaration of the variable it concerns.
+func (p *parser) variableError(err error) {
+	var pos position
+	switch e := err.(type) {
+	case *CycleError:
+		pos = p.config.sources[e.Chain[0]]
+	case *VariableError:
+		pos = p.config.sources[e.Name]
+	default:
+		p.errorAt(p.name, 0, "%s", err)
+	}
+	p.errorAt(pos.file, pos.line, "%s", err)
+}
+
+// parseFile parses the text of a single file into p.config.
+func (p *parser) parseFile() {
+	p.lex = lex(p.name, p.text)
+	p.parseStatements()
+}
+
+// parseStatements parses top-level statements until the end of the file, or
+// the end of the profile section being parsed. A statement that fails to
+// parse is skipped, so that later problems are found too.
+func (p *parser) parseStatements() {
 	for {
-		for {
-			var k, v string
-			k, v, err = p.parseVariable()
-			if err != nil {
-				p.errorf("%s", err)
+		done := false
+		if !p.try(func() { done = p.parseStatement() }) {
+			p.synchronize()
+		}
+		if done {
+			return
+		}
+	}
+}
+
+// parseStatement parses a single top-level statement. It returns true at the
+// end of the file or profile section.
+func (p *parser) parseStatement() bool {
+	switch p.peek().typ {
+	case itemEOF:
+		if p.section {
+			p.report(p.peek(), "add a closing } for the profile", "unterminated profile %s", p.profile)
+		}
+		return true
+	case itemRightParen:
+		p.next()
+		if !p.section {
+			p.errorf("unexpected }")
+		}
+		return true
+	case itemVarName:
+		at := p.peek()
+		pos := position{p.name, p.lineOf(at)}
+		d := p.parseVariable()
+		var err error
+		if p.profile != "" {
+			err = p.config.addProfileVariable(p.profile, d, pos)
+		} else if d.isDefault {
+			err = p.config.addDefault(d.name, d.value, d.command, pos)
+		} else if p.override {
+			p.config.setVariable(d.name, d.value, d.command, pos)
+		} else {
+			err = p.config.addVariable(d.name, d.value, d.command, pos)
+		}
+		if err != nil {
+			p.report(at, "", "%s", err)
+		}
+	case itemInclude:
+		p.parseInclude()
+	case itemProfile:
+		p.parseProfile()
+	default:
+		at := p.peek()
+		block, disable := p.parseBlock()
+		if !disable {
+			if err := p.config.addBlock(*block); err != nil {
+				p.report(at, "", "%s", err)
 			}
-			if k == "" && v == "" {
-				break
+		} else if p.config.disableBlocks(block) == 0 {
+			if block.Name != "" {
+				p.report(at, "", "no block named %q to disable", block.Name)
+			} else {
+				p.report(at, "", "no block matches the patterns of the disabled block")
 			}
-			err = p.config.addVariable(k, v)
-			if err != nil {
-				p.errorf("%s", err)
+		}
+	}
+	return false
+}
+
+// synchronize skips the remains of a top-level statement that failed to
+// parse, up to the start of the next statement.
+func (p *parser) synchronize() {
+	for {
+		switch p.peek().typ {
+		case itemEOF, itemVarName, itemInclude, itemProfile, itemBareString, itemQuotedString, itemLeftParen:
+			return
+		case itemRightParen:
+			if p.section {
+				return
+			}
+		case itemInDir, itemName, itemDaemon, itemPrep, itemColon:
+			// The body of a block whose patterns couldn't be parsed
+			for {
+				t := p.peek().typ
+				if t == itemEOF {
+					return
+				}
+				p.skip()
+				if t == itemRightParen {
+					break
+				}
 			}
+			continue
 		}
-		if p.peek().typ == itemEOF {
-			break
+		p.skip()
+	}
+}
+
+// parseInclude reads the file named by an include statement and splices its
+// blocks and variables into the config. Relative paths are resolved against
+// the directory of the including file.
+func (p *parser) parseInclude() {
+	p.next()
+	incpath := prepValue(p.mustNext(itemBareString, itemQuotedString))
+	if incpath == "" {
+		p.errorf("include needs a path")
+	}
+	if !filepath.IsAbs(incpath) {
+		incpath = filepath.Join(filepath.Dir(p.name), incpath)
+	}
+	chain := append(append([]string{}, p.chain...), incpath)
+	for _, f := range p.chain {
+		if SamePath(f, incpath) {
+			p.errorf("include cycle: %s", strings.Join(chain, " -> "))
 		}
-		p.config.addBlock(*p.parseBlock())
 	}
-	return err
+	text, err := os.ReadFile(incpath)
+	if err != nil {
+		p.errorf("%s", err)
+	}
+	p.config.Includes = append(p.config.Includes, incpath)
+	inc := &parser{
+		name:        incpath,
+		text:        string(text),
+		config:      p.config,
+		chain:       chain,
+		override:    p.override,
+		profile:     p.profile,
+		diagnostics: p.diagnostics,
+	}
+	inc.parseFile()
 }
 
-func (p *parser) parseVariable() (string, string, error) {
-	if p.peek().typ != itemVarName {
-		return "", "", nil
+// parseProfile parses a profile section. Blocks in the section are tagged
+// with the name of the profile, and its variables are set aside, until we know
+// which profile is in use.
+func (p *parser) parseProfile() {
+	p.next()
+	if p.override {
+		p.reportf("profiles can't be declared in a local override file")
+	}
+	if p.profile != "" {
+		p.reportf("profiles can't be nested")
 	}
-	name := p.next().val
+	name := "{invalid}"
+	at := p.peek()
+	if at.typ == itemBareString && !strings.HasPrefix(at.val, "+") {
+		name = p.next().val
+	} else {
+		p.report(p.peek(), "", "profile needs a name")
+	}
+	isDefault := false
+	for _, o := range p.collect(itemBareString) {
+		switch o.val {
+		case "+default":
+			isDefault = true
+		default:
+			p.report(o, didYouMean(o.val, []string{"+default"}), "unknown profile option: %s", o.val)
+		}
+	}
+	p.mustNext(itemLeftParen)
+	if err := p.config.addProfile(name, isDefault); err != nil {
+		p.report(at, "", "%s", err)
+	}
+	outer, section := p.profile, p.section
+	p.profile, p.section = name, true
+	p.parseStatements()
+	p.profile, p.section = outer, section
+}
+
+// selectProfile applies the named profile, or the default profile if name is
+// empty, or with fallback, if the config doesn't declare it. The blocks and
+// variables of other profiles are dropped.
+func (p *parser) selectProfile(name string, fallback bool) {
+	if name == "" || fallback && !containsString(p.config.Profiles, name) {
+		name = p.config.DefaultProfile
+	} else if !containsString(p.config.Profiles, name) {
+		if len(p.config.Profiles) == 0 {
+			p.errorAt(p.name, 0, "unknown profile %q: no profiles are declared", name)
+		}
+		p.errorAt(
+			p.name, 0, "unknown profile %q, expected one of: %s",
+			name, strings.Join(p.config.Profiles, ", "),
+		)
+	}
+	var blocks []Block
+	for _, b := range p.config.Blocks {
+		if b.profile == "" || b.profile == name {
+			b.profile = ""
+			blocks = append(blocks, b)
+		}
+	}
+	p.config.Blocks = blocks
+	for _, v := range p.config.profileVariables[name] {
+		var err error
+		if v.isDefault {
+			// A default in the profile replaces a global default
+			if p.config.defaults[v.name] {
+				delete(p.config.variables, v.name)
+			}
+			err = p.config.addDefault(v.name, v.value, v.command, v.pos)
+		} else {
+			p.config.setVariable(v.name, v.value, v.command, v.pos)
+		}
+		if err != nil {
+			p.errorAt(v.pos.file, v.pos.line, "%s", err)
+		}
+	}
+	p.config.profileVariables = nil
+	p.config.Profile = name
+}
+
+// SamePath checks whether two file names refer to the same path
+func SamePath(a, b string) bool {
+	absa, erra := filepath.Abs(a)
+	absb, errb := filepath.Abs(b)
+	if erra != nil || errb != nil {
+		return filepath.Clean(a) == filepath.Clean(b)
+	}
+	return absa == absb
+}
+
+// A declaration is a parsed variable declaration
+type declaration struct {
+	name  string
+	value string
+	// The value is a default declared with ?=
+	isDefault bool
+	// Set if the value is a command in $(...)
+	command *command
+}
+
+// parseVariable parses a variable declaration
+func (p *parser) parseVariable() declaration {
+	d := declaration{name: p.mustNext(itemVarName).val}
+	options := p.collect(itemBareString)
 
 	eq := p.next()
-	if eq.typ != itemEquals {
-		p.errorf("Expected =")
+	if eq.typ != itemEquals && eq.typ != itemDefaultEquals {
+		p.fail(eq, "", "Expected =")
 	}
+	d.isDefault = eq.typ == itemDefaultEquals
 	nxt := p.next()
-	val := ""
 	if nxt.typ == itemQuotedString {
-		val = unquote(nxt.val)
+		d.value = strings.TrimSpace(unquote(nxt.val))
 	} else if nxt.typ == itemBareString {
-		val = nxt.val
+		d.value = strings.TrimSpace(nxt.val)
+		// Quoting the value keeps $(...) as literal text
+		if strings.HasPrefix(d.value, "$(") && strings.HasSuffix(d.value, ")") {
+			text := strings.TrimSpace(d.value[2 : len(d.value)-1])
+			if text == "" {
+				p.reportf("empty command in variable %s", d.name)
+			}
+			d.command = &command{text: text}
+		}
 	} else {
 		p.errorf("Expected variable value")
 	}
-	val = strings.TrimSpace(val)
-	return name, val, nil
+	for _, o := range options {
+		switch o.val {
+		case "+ontrigger":
+			if d.command == nil {
+				p.report(o, "", "+ontrigger can only be used with a $(...) value")
+				continue
+			}
+			d.command.perTrigger = true
+		default:
+			p.report(o, didYouMean(o.val, []string{"+ontrigger"}), "unknown variable option: %s", o.val)
+		}
+	}
+	return d
 }
 
 func prepValue(itm item) string {
@@ -223,69 +615,362 @@ func prepValue(itm item) string {
 	return strings.TrimSpace(val)
 }
 
-func (p *parser) parseBlock() *Block {
-	block := &Block{}
-	block.Include, block.Exclude, block.NoCommonFilter = p.collectPatterns()
+// lineOf returns the line an item starts on
+func (p *parser) lineOf(itm item) int {
+	return 1 + strings.Count(p.lex.input[:itm.pos], "\n")
+}
+
+// parseBlock parses a block. The second return value is true if the block is
+// flagged with +disable, in which case it only identifies blocks to remove.
+func (p *parser) parseBlock() (*Block, bool) {
+	start := p.peek()
+	block := &Block{Source: p.name, Line: p.lineOf(start), profile: p.profile}
+	disable := false
+	var flags []string
+	block.Include, block.Exclude, flags = p.collectPatterns()
+	for _, f := range flags {
+		switch f {
+		case "+noignore":
+			block.NoCommonFilter = true
+		case "+strict":
+			block.Strict = true
+		case "+concurrent":
+			block.Concurrent = true
+		case "+restart-on-change":
+			block.RestartOnChange = true
+		case "+disable":
+			if !p.override {
+				p.reportf("+disable can only be used in a local override file")
+				continue
+			}
+			disable = true
+		default:
+			block.conditions = append(block.conditions, f)
+		}
+	}
 	nxt := p.next()
 	if nxt.typ != itemLeftParen {
-		p.errorf("expected block open parentheses, got %q", nxt.val)
+		p.fail(nxt, "a block's patterns must be followed by {", "expected block open parentheses, got %q", nxt.val)
+	}
+	for {
+		// The lexer has already reported the missing }
+		if p.peek().typ == itemEOF {
+			return block, disable
+		}
+		done := false
+		if !p.try(func() { done = p.parseDirective(block) }) {
+			p.skipDirective()
+		}
+		if done {
+			break
+		}
+	}
+	// A disabled block may only carry a name, which identifies the block to
+	// remove
+	if disable && (block.InDir != "" || block.Preps != nil || block.Daemons != nil || block.Variables != nil) {
+		p.report(start, "", "a block flagged with +disable must be empty")
 	}
-Loop:
+	if _, err := resolveAll(block.Variables, nil); err != nil {
+		p.reportAt(block.Source, block.Line, "%s", err)
+	}
+	return block, disable
+}
+
+// parseDirective parses a single directive in the body of a block. It returns
+// true at the end of the block.
+func (p *parser) parseDirective(block *Block) bool {
+	nxt := p.next()
+	switch nxt.typ {
+	case itemInDir:
+		if options := p.collect(itemBareString); len(options) > 0 {
+			p.report(options[0], "", "indir takes no options")
+		}
+		p.mustNext(itemColon)
+		dir := prepValue(p.mustNext(itemBareString, itemQuotedString))
+		if block.InDir != "" {
+			p.report(nxt, "", "indir can only be used once per block")
+		}
+		block.InDir = dir
+	case itemVarName:
+		p.peekItem = &nxt
+		d := p.parseVariable()
+		if d.isDefault {
+			p.report(nxt, "", "default values can only be declared at the top level")
+		}
+		if d.command != nil {
+			p.report(nxt, "", "computed variables can only be declared at the top level")
+		}
+		if err := block.addVariable(d.name, d.value); err != nil {
+			p.report(nxt, "", "%s", err)
+		}
+	case itemName:
+		if options := p.collect(itemBareString); len(options) > 0 {
+			p.report(options[0], "", "name takes no options")
+		}
+		p.mustNext(itemColon)
+		name := prepValue(p.mustNext(itemBareString, itemQuotedString))
+		if block.Name != "" {
+			p.report(nxt, "", "name can only be used once per block")
+		}
+		if name == "" || strings.ContainsAny(name, whitespace) {
+			p.reportf("invalid block name: %q", name)
+		}
+		block.Name = name
+	case itemDaemon:
+		items := p.collect(itemBareString)
+		options, conds := splitConditions(values(items))
+		p.mustNext(itemColon)
+		err := block.addDaemon(
+			prepValue(p.mustNext(itemBareString, itemQuotedString)),
+			options,
+		)
+		if err != nil {
+			p.failOption(items, err)
+		}
+		block.daemonConditions = append(block.daemonConditions, conds)
+	case itemPrep:
+		items := p.collect(itemBareString)
+		options, conds := splitConditions(values(items))
+		p.mustNext(itemColon)
+		err := block.addPrep(
+			prepValue(p.mustNext(itemBareString, itemQuotedString)),
+			options,
+		)
+		if err != nil {
+			p.failOption(items, err)
+		}
+		block.prepConditions = append(block.prepConditions, conds)
+	case itemRightParen:
+		return true
+	default:
+		p.errorf("unexpected input: %s", nxt.val)
+	}
+	return false
+}
+
+// skipDirective skips the remains of a directive that failed to parse, up to
+// the start of the next directive or the end of the block.
+func (p *parser) skipDirective() {
 	for {
-		nxt = p.next()
-		switch nxt.typ {
-		case itemInDir:
-			options := p.collectValues(itemBareString)
-			if len(options) > 0 {
-				p.errorf("indir takes no options")
+		switch p.peek().typ {
+		case itemInDir, itemName, itemDaemon, itemPrep, itemVarName, itemRightParen, itemEOF:
+			return
+		}
+		p.skip()
+	}
+}
+
+// failOption records an error in the options of a command, at the offending
+// option if it can be told, and abandons the current parsing step.
+func (p *parser) failOption(options []item, err error) {
+	if oe, ok := err.(*optionError); ok {
+		for _, o := range options {
+			if o.val == oe.option {
+				p.fail(o, oe.hint, "%s", err)
 			}
-			p.mustNext(itemColon)
-			dir := prepValue(p.mustNext(itemBareString, itemQuotedString))
-			if block.InDir != "" {
-				p.errorf("indir can only be used once per block")
+		}
+		p.fail(p.token, oe.hint, "%s", err)
+	}
+	p.fail(p.token, "", "%s", err)
+}
+
+// applyConditions removes the blocks, prep commands and daemons whose
+// conditions don't hold. Block conditions can refer to global variables, and
+// command conditions to the variables of their block as well. Names are
+// checked for duplicates among the blocks that remain.
+func (p *parser) applyConditions() {
+	globals := p.config.GetVariables()
+	var blocks []Block
+	names := map[string]bool{}
+	for _, b := range p.config.Blocks {
+		p.try(func() {
+			if !p.applyBlockConditions(&b, globals) {
+				return
 			}
-			// Replace @confdir here instead of at command runtime
-			dir = strings.Replace(
-				dir, confVarName, p.config.variables[confVarName], -1,
-			)
-			dir, err := filepath.Abs(dir)
-			if err != nil {
-				p.errorf("%s", err)
+			if b.Name != "" && names[b.Name] {
+				p.errorAt(b.Source, b.Line, "duplicate block name: %s", b.Name)
 			}
-			block.InDir = dir
-		case itemDaemon:
-			options := p.collectValues(itemBareString)
-			p.mustNext(itemColon)
-			err := block.addDaemon(
-				prepValue(p.mustNext(itemBareString, itemQuotedString)),
-				options,
-			)
-			if err != nil {
-				p.errorf("%s", err)
+			names[b.Name] = true
+			blocks = append(blocks, b)
+		})
+	}
+	p.config.Blocks = blocks
+}
+
+// applyBlockConditions evaluates the conditions of a block and its commands.
+// It returns false if the whole block is to be removed.
+func (p *parser) applyBlockConditions(b *Block, globals map[string]string) bool {
+	ok, err := evalConditions(b.conditions, globals)
+	if err != nil {
+		p.errorAt(b.Source, b.Line, "%s", err)
+	}
+	if !ok {
+		return false
+	}
+	vars := b.Scope(globals)
+	var preps []Prep
+	for i, pr := range b.Preps {
+		ok, err := evalConditions(b.prepConditions[i], vars)
+		if err != nil {
+			p.errorAt(b.Source, b.Line, "%s", err)
+		}
+		if ok {
+			preps = append(preps, pr)
+		}
+	}
+	var daemons []Daemon
+	for i, d := range b.Daemons {
+		ok, err := evalConditions(b.daemonConditions[i], vars)
+		if err != nil {
+			p.errorAt(b.Source, b.Line, "%s", err)
+		}
+		if ok {
+			daemons = append(daemons, d)
+		}
+	}
+	b.Preps, b.Daemons = preps, daemons
+	b.conditions, b.prepConditions, b.daemonConditions = nil, nil, nil
+	return true
+}
+
+// setRoot sets the directory patterns are relative to, made absolute
+func (p *parser) setRoot(root string) {
+	if root == "" {
+		return
+	}
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		p.errorAt(p.name, 0, "%s", err)
+	}
+	p.root = abs
+}
+
+// confDir returns the value of @confdir. It is absolute when the config has
+// a root, since patterns are then relative to the root rather than the
+// current directory.
+func (p *parser) confDir() string {
+	if p.root == "" {
+		return path.Dir(p.name)
+	}
+	dir, err := filepath.Abs(filepath.Dir(p.name))
+	if err != nil {
+		return path.Dir(p.name)
+	}
+	return filepath.ToSlash(dir)
+}
+
+// expandBlocks expands variable references in the patterns and indir of every
+// block. This happens once all declarations and overrides are known.
+func (p *parser) expandBlocks() {
+	globals := p.config.GetVariables()
+	for i := range p.config.Blocks {
+		b := &p.config.Blocks[i]
+		b.Root = p.root
+		p.try(func() {
+			for j, pat := range b.Include {
+				b.Include[j] = p.expandPattern(b, pat, globals)
 			}
-		case itemPrep:
-			options := p.collectValues(itemBareString)
-			p.mustNext(itemColon)
-			err := block.addPrep(
-				prepValue(p.mustNext(itemBareString, itemQuotedString)),
-				options,
-			)
-			if err != nil {
-				p.errorf("%s", err)
+			for j, pat := range b.Exclude {
+				b.Exclude[j] = p.expandPattern(b, pat, globals)
 			}
-		case itemRightParen:
-			break Loop
-		default:
-			p.errorf("unexpected input: %s", nxt.val)
+			if b.InDir != "" {
+				b.InDir = p.resolveInDir(b, globals)
+			}
+		})
+	}
+}
+
+// expandPattern expands the variable references in a pattern of block b.
+// Patterns can only refer to global variables.
+func (p *parser) expandPattern(b *Block, pat string, globals map[string]string) string {
+	ret, err := Expand(pat, func(name string) (string, error) {
+		if v, ok := globals[name]; ok {
+			return v, nil
+		}
+		return "", fmt.Errorf("unknown variable %s in pattern %q", name, pat)
+	})
+	if err != nil {
+		p.errorAt(b.Source, b.Line, "%s", err)
+	}
+	if ret != pat {
+		// Expanding @confdir leaves a leading ./ that never matches
+		for strings.HasPrefix(ret, "./") {
+			ret = ret[2:]
+		}
+	}
+	if p.root != "" && filepath.IsAbs(filepath.FromSlash(ret)) {
+		// Changes are reported relative to the root, so patterns under it
+		// have to be too. An absolute @confdir makes them absolute.
+		root := strings.TrimSuffix(filepath.ToSlash(filepath.Clean(p.root)), "/") + "/"
+		if strings.HasPrefix(ret, root) {
+			ret = ret[len(root):]
+		}
+	}
+	return ret
+}
+
+// resolveInDir expands the variable references in the block's indir, and
+// makes it absolute, relative to the root if there is one. We do this at
+// parse time, rather than at command runtime.
+func (p *parser) resolveInDir(b *Block, globals map[string]string) string {
+	vars := b.Scope(globals)
+	dir, err := Expand(b.InDir, func(name string) (string, error) {
+		if v, ok := vars[name]; ok {
+			return v, nil
 		}
+		return "", fmt.Errorf("unknown variable %s in indir", name)
+	})
+	if err != nil {
+		p.errorAt(b.Source, b.Line, "%s", err)
+	}
+	if p.root != "" && !filepath.IsAbs(dir) {
+		dir = filepath.Join(p.root, dir)
 	}
-	return block
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		p.errorAt(b.Source, b.Line, "%s", err)
+	}
+	return dir
+}
+
+// Options controls optional parsing behaviour
+type Options struct {
+	// Local is the path of a local override file, which is parsed after the
+	// main config. Variables declared in it replace earlier declarations,
+	// blocks flagged with +disable remove all blocks with the same patterns,
+	// and other blocks are appended. A missing file is ignored.
+	Local string
+	// Variables maps variable names, including the leading @, to values that
+	// override the declarations in every scope. Variables that aren't declared
+	// in the config are added as globals.
+	Variables map[string]string
+	// Profile is the name of the profile to use. If it is empty, the default
+	// profile is used, if there is one.
+	Profile string
+	// ProfileFallback uses the default profile when the config doesn't
+	// declare Profile, instead of reporting an error. It is for configs run
+	// together, where the profile only has to exist in one of them.
+	ProfileFallback bool
+	// Eval runs the commands of variables with a $(...) value. If it is nil,
+	// the commands aren't run, and the variables keep their unevaluated
+	// values.
+	Eval EvalFunc
+	// Root is the directory that patterns and relative indir paths are
+	// resolved against, and that commands run in by default. If it is empty,
+	// the current directory is used. When it is set, @confdir is absolute.
+	Root string
 }
 
 // Parse parses a string, and returns a completed Config
 func Parse(name string, text string) (*Config, error) {
+	return ParseWithOptions(name, text, Options{})
+}
+
+// ParseWithOptions parses a string with the given options, and returns a
+// completed Config
+func ParseWithOptions(name string, text string, opts Options) (*Config, error) {
 	p := &parser{name: name, text: text}
-	err := p.parse()
+	err := p.parse(opts)
 	if err != nil {
 		return nil, err
 	}
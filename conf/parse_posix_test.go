@@ -29,6 +29,15 @@ var parsePosixTests = []struct {
 	},
 }
 
+var parseErrorPosixTests = []struct {
+	input string
+	err   string
+}{
+	{"{\ndaemon +sigtrem: foo\n}", "test:2:8: unknown signal: sigtrem (did you mean sigterm?)"},
+	{"{\ndaemon +onchange: foo\n}", "test:2:8: unknown signal: onchange (+onchange only applies to prep commands)"},
+}
+
 func init() {
 	parseTests = append(parseTests, parsePosixTests...)
+	parseErrorTests = append(parseErrorTests, parseErrorPosixTests...)
 }
@@ -1,13 +1,18 @@
 package conf
 
 import (
+	"errors"
+	"fmt"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"runtime"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 )
 
 func mustAbs(s string) string {
@@ -183,6 +188,55 @@ var parseTests = []struct {
 			},
 		},
 	},
+	{
+		"",
+		"foo +strict +concurrent +restart-on-change {\nprep +allowfail: lint\nprep +always: cleanup\n}",
+		&Config{
+			Blocks: []Block{
+				{
+					Include:         []string{"foo"},
+					Strict:          true,
+					Concurrent:      true,
+					RestartOnChange: true,
+					Preps: []Prep{
+						{Command: "lint", AllowFail: true},
+						{Command: "cleanup", Always: true},
+					},
+				},
+			},
+		},
+	},
+	{
+		"",
+		"foo {\nprep +retry=2: a\nprep +retry=3,backoff=500ms: b\n}",
+		&Config{
+			Blocks: []Block{
+				{
+					Include: []string{"foo"},
+					Preps: []Prep{
+						{Command: "a", Retries: 2},
+						{Command: "b", Retries: 3, Backoff: 500 * time.Millisecond},
+					},
+				},
+			},
+		},
+	},
+	{
+		"",
+		"foo {\nprep +parallel: a\nprep +parallel: b\nprep: c\n}",
+		&Config{
+			Blocks: []Block{
+				{
+					Include: []string{"foo"},
+					Preps: []Prep{
+						{Command: "a", Parallel: true},
+						{Command: "b", Parallel: true},
+						{Command: "c"},
+					},
+				},
+			},
+		},
+	},
 	{
 		"",
 		"foo {\nprep: 'command\n-one\n-two'}",
@@ -214,7 +268,7 @@ var parseTests = []struct {
 			Blocks: []Block{
 				{
 					Include: []string{"foo", "bar"},
-					Preps:   []Prep{{"command", false}},
+					Preps:   []Prep{{Command: "command", Onchange: false}},
 				},
 			},
 		},
@@ -276,6 +330,59 @@ var parseTests = []struct {
 			},
 		},
 	},
+	{
+		"",
+		"foo {\nname: api\nprep: command\n}",
+		&Config{
+			Blocks: []Block{
+				{
+					Include: []string{"foo"},
+					Name:    "api",
+					Preps:   []Prep{{Command: "command"}},
+				},
+			},
+		},
+	},
+	{
+		"",
+		"@a ?= one\n@b ?= two\n@b = three\n@c = four\n@c ?= five\n",
+		&Config{
+			variables: map[string]string{
+				"@a": "one",
+				"@b": "three",
+				"@c": "four",
+			},
+			defaults: map[string]bool{"@a": true},
+		},
+	},
+	{
+		"",
+		"@a = global\nfoo {\n@a = one\n@b = 'two'\nprep: command\n}",
+		&Config{
+			Blocks: []Block{
+				{
+					Include:   []string{"foo"},
+					Variables: map[string]string{"@a": "one", "@b": "two"},
+					Preps:     []Prep{{Command: "command"}},
+				},
+			},
+			variables: map[string]string{
+				"@a": "global",
+			},
+		},
+	},
+	{
+		"",
+		"{\n@dir = foo\nindir: @dir/bar\n}",
+		&Config{
+			Blocks: []Block{
+				{
+					InDir:     mustAbs("foo/bar"),
+					Variables: map[string]string{"@dir": "foo"},
+				},
+			},
+		},
+	},
 	{
 		"",
 		"{ indir: foo\n }",
@@ -299,7 +406,7 @@ var parseTests = []struct {
 		"{ indir: @confdir/foo\n }",
 		&Config{
 			Blocks: []Block{
-				{InDir: mustAbs("path/to/foo")},
+				{InDir: mustAbs("path/to/foo"), Source: "./path/to/ppow.conf"},
 			},
 			variables: map[string]string{
 				"@confdir": "path/to",
@@ -309,7 +416,9 @@ var parseTests = []struct {
 }
 
 var parseCmpOptions = []cmp.Option{
-	cmp.AllowUnexported(Config{}),
+	cmp.AllowUnexported(Config{}, Block{}),
+	cmpopts.IgnoreFields(Config{}, "sources"),
+	cmpopts.IgnoreFields(Block{}, "Line"),
 }
 
 func TestParse(t *testing.T) {
@@ -354,25 +463,632 @@ func TestParseExt(t *testing.T) {
 	}
 }
 
+func TestParseInclude(t *testing.T) {
+	d := t.TempDir()
+	files := map[string]string{
+		"ppow.conf":        "@a = one\ninclude sub/common.conf\nfoo {}\n",
+		"sub/common.conf":  "@b = two\ninclude 'more.conf'\nbar {}\n",
+		"sub/more.conf":    "baz {}\n",
+		"cycle.conf":       "include sub/cycle.conf\n",
+		"sub/cycle.conf":   "include ../cycle.conf\n",
+		"missing.conf":     "include nonexistent.conf\n",
+		"sub/invalid.conf": "@b = two\n@b = three\n",
+		"invalid.conf":     "include sub/invalid.conf\n",
+		"profile.conf":     "profile dev {\ninclude sub/dev.conf\n}\nprofile ci +default {\nci {}\n}\n",
+		"sub/dev.conf":     "@mode = dev\ndev {}\n",
+		"brace.conf":       "profile dev {\ninclude sub/brace.conf\n}\n",
+		"sub/brace.conf":   "dev {}\n}\n",
+	}
+	for name, text := range files {
+		p := filepath.Join(d, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	main := filepath.Join(d, "ppow.conf")
+	ret, err := Parse(main, files["ppow.conf"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &Config{
+		Blocks: []Block{
+			{Include: []string{"baz"}, Source: filepath.Join(d, "sub", "more.conf")},
+			{Include: []string{"bar"}, Source: filepath.Join(d, "sub", "common.conf")},
+			{Include: []string{"foo"}, Source: main},
+		},
+		Includes: []string{
+			filepath.Join(d, "sub", "common.conf"),
+			filepath.Join(d, "sub", "more.conf"),
+		},
+		variables: map[string]string{
+			"@confdir": d,
+			"@a":       "one",
+			"@b":       "two",
+		},
+	}
+	if diff := cmp.Diff(ret, expected, parseCmpOptions...); diff != "" {
+		t.Error(diff)
+	}
+
+	cycle := filepath.Join(d, "cycle.conf")
+	_, err = Parse(cycle, files["cycle.conf"])
+	expectedErr := fmt.Sprintf(
+		"%s:1:9: include cycle: %s -> %s -> %s",
+		filepath.Join(d, "sub", "cycle.conf"),
+		cycle, filepath.Join(d, "sub", "cycle.conf"), cycle,
+	)
+	if err == nil || err.Error() != expectedErr {
+		t.Errorf("Expected\n%q\ngot\n%v", expectedErr, err)
+	}
+
+	_, err = Parse(filepath.Join(d, "missing.conf"), files["missing.conf"])
+	if err == nil {
+		t.Error("Expected error for missing include")
+	}
+
+	_, err = Parse(filepath.Join(d, "invalid.conf"), files["invalid.conf"])
+	expectedErr = fmt.Sprintf(
+		"%s:2:1: variable @b shadows previous declaration",
+		filepath.Join(d, "sub", "invalid.conf"),
+	)
+	if err == nil || err.Error() != expectedErr {
+		t.Errorf("Expected\n%q\ngot\n%v", expectedErr, err)
+	}
+
+	profile := filepath.Join(d, "profile.conf")
+	ret, err = ParseWithOptions(profile, files["profile.conf"], Options{Profile: "dev"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"dev"}, ret.IncludePatterns()); diff != "" {
+		t.Error(diff)
+	}
+	if ret.GetVariables()["@mode"] != "dev" {
+		t.Errorf("Unexpected variables %v", ret.GetVariables())
+	}
+	ret, err = Parse(profile, files["profile.conf"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"ci"}, ret.IncludePatterns()); diff != "" {
+		t.Error(diff)
+	}
+
+	_, err = Parse(filepath.Join(d, "brace.conf"), files["brace.conf"])
+	expectedErr = fmt.Sprintf("%s:2:1: unexpected } (remove it, or add the { it should close)",
+		filepath.Join(d, "sub", "brace.conf"),
+	)
+	if err == nil || err.Error() != expectedErr {
+		t.Errorf("Expected\n%q\ngot\n%v", expectedErr, err)
+	}
+}
+
+func TestParseLocal(t *testing.T) {
+	d := t.TempDir()
+	main := filepath.Join(d, "ppow.conf")
+	local := filepath.Join(d, "ppow.local.conf")
+	text := "@a = one\n@b = two\nfoo {\nprep: a\n}\nbar {\nprep: b\n}\n"
+	err := os.WriteFile(
+		local,
+		[]byte("@b = three\n@c = four\nfoo +disable {}\nbaz {\nprep: c\n}\n"),
+		0o644,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ret, err := ParseWithOptions(main, text, Options{Local: local})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &Config{
+		Blocks: []Block{
+			{Include: []string{"bar"}, Source: main, Preps: []Prep{{Command: "b"}}},
+			{Include: []string{"baz"}, Source: local, Preps: []Prep{{Command: "c"}}},
+		},
+		variables: map[string]string{
+			"@confdir": d,
+			"@a":       "one",
+			"@b":       "three",
+			"@c":       "four",
+		},
+	}
+	if diff := cmp.Diff(ret, expected, parseCmpOptions...); diff != "" {
+		t.Error(diff)
+	}
+	for k, src := range map[string]string{"@a": main, "@b": local, "@c": local} {
+		if ret.VariableSource(k) != src {
+			t.Errorf("Expected %s to come from %s, got %s", k, src, ret.VariableSource(k))
+		}
+	}
+
+	_, err = ParseWithOptions(main, text, Options{Local: filepath.Join(d, "nonexistent")})
+	if err != nil {
+		t.Errorf("Missing local file should be ignored: %s", err)
+	}
+
+	err = os.WriteFile(local, []byte("+disable {\nname: api\n}\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret, err = ParseWithOptions(main, "{\nname: api\n}\nfoo {\nname: web\n}\n", Options{Local: local})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ret.Blocks) != 1 || ret.Blocks[0].Name != "web" {
+		t.Errorf("Expected only block web to remain, got %#v", ret.Blocks)
+	}
+
+	err = os.WriteFile(local, []byte("voing +disable {}\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ParseWithOptions(main, text, Options{Local: local})
+	expectedErr := local + ":1:1: no block matches the patterns of the disabled block"
+	if err == nil || err.Error() != expectedErr {
+		t.Errorf("Expected\n%q\ngot\n%v", expectedErr, err)
+	}
+
+	err = os.WriteFile(local, []byte("foo +disable {\nprep: a\n}\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ParseWithOptions(main, text, Options{Local: local})
+	expectedErr = local + ":1:1: a block flagged with +disable must be empty"
+	if err == nil || err.Error() != expectedErr {
+		t.Errorf("Expected\n%q\ngot\n%v", expectedErr, err)
+	}
+}
+
+func TestParseVariableOverrides(t *testing.T) {
+	text := "@port ?= 8080\n@env = dev\n@url = http://localhost:@port\n{\n@env = test\nprep: true\n}\n"
+	ret, err := ParseWithOptions("", text, Options{
+		Variables: map[string]string{"@port": "9000", "@env": "staging", "@new": "x"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"@port": "9000",
+		"@env":  "staging",
+		"@url":  "http://localhost:9000",
+		"@new":  "x",
+	}
+	if diff := cmp.Diff(ret.GetVariables(), expected); diff != "" {
+		t.Error(diff)
+	}
+	if ret.Blocks[0].Variables["@env"] != "staging" {
+		t.Errorf("Override did not apply to block variable: %#v", ret.Blocks[0].Variables)
+	}
+	if ret.VariableSource("@port") != "command line" {
+		t.Errorf("Unexpected source %q", ret.VariableSource("@port"))
+	}
+
+	_, err = ParseWithOptions("", "@a = x\n", Options{
+		Variables: map[string]string{"@a": "@b", "@b": "@a"},
+	})
+	if err == nil || err.Error() != "command line: variable cycle: @a -> @b -> @a" {
+		t.Errorf("Expected cycle error, got %v", err)
+	}
+}
+
+func TestParseCommands(t *testing.T) {
+	runs := 0
+	eval := func(shell string, dir string, command string) (string, error) {
+		runs++
+		if command == "fail" {
+			return "", errors.New("exit status 1: boom")
+		}
+		return fmt.Sprintf("%s|%s|%d", shell, command, runs), nil
+	}
+	text := "@shell = sh\n@dir = src\n@rev = $(ls @dir)\n@tag = v-@rev\n" +
+		"@lit = \"$(date)\"\n@now +ontrigger = $(date)\n@stamp = @now\n"
+	ret, err := ParseWithOptions("", text, Options{Eval: eval})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"@shell": "sh",
+		"@dir":   "src",
+		"@rev":   "sh|ls src|2",
+		"@tag":   "v-sh|ls src|2",
+		"@lit":   "$(date)",
+		"@now":   "sh|date|1",
+		"@stamp": "sh|date|1",
+	}
+	if diff := cmp.Diff(ret.GetVariables(), expected); diff != "" {
+		t.Error(diff)
+	}
+	if runs != 2 {
+		t.Errorf("Expected 2 runs, got %d", runs)
+	}
+
+	vars, err := ret.TriggerVariables(eval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected["@now"] = "sh|date|3"
+	expected["@stamp"] = "sh|date|3"
+	if diff := cmp.Diff(vars, expected); diff != "" {
+		t.Error(diff)
+	}
+
+	ret, err = ParseWithOptions("", "@rev = $(ls)\n", Options{
+		Eval:      eval,
+		Variables: map[string]string{"@rev": "fixed"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret.GetVariables()["@rev"] != "fixed" || runs != 3 {
+		t.Errorf("Overridden command was run: %v", ret.GetVariables())
+	}
+
+	_, err = ParseWithOptions("test", "@a = b\n@rev = $(fail)\n", Options{Eval: eval})
+	if err == nil || err.Error() != "test:2: @rev: exit status 1: boom" {
+		t.Errorf("Expected command error, got %v", err)
+	}
+}
+
+func TestParseEnv(t *testing.T) {
+	t.Setenv("PPOW_TEST_SRC", "src")
+	text := "@out = @env.PPOW_TEST_OUT:-build\n" +
+		"@env.PPOW_TEST_SRC/** !@env.PPOW_TEST_SKIP:-vendor/** {\nindir: @env.PPOW_TEST_SRC\n}\n"
+	ret, err := Parse("", text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := ret.Blocks[0]
+	if diff := cmp.Diff([]string{"src/**"}, b.Include); diff != "" {
+		t.Error(diff)
+	}
+	if diff := cmp.Diff([]string{"vendor/**"}, b.Exclude); diff != "" {
+		t.Error(diff)
+	}
+	if b.InDir != mustAbs("src") {
+		t.Errorf("Unexpected indir %q", b.InDir)
+	}
+	if ret.GetVariables()["@out"] != "build" {
+		t.Errorf("Unexpected variables %v", ret.GetVariables())
+	}
+
+	_, err = Parse("test", "@a = b\n@out = @env.PPOW_TEST_UNSET\n")
+	if err == nil || err.Error() != "test:2: @out: environment variable PPOW_TEST_UNSET is not set" {
+		t.Errorf("Expected unset error, got %v", err)
+	}
+}
+
+func TestParsePatternVariables(t *testing.T) {
+	text := "@src ?= services/api\n@gen = @src/gen\n" +
+		"@src/**/*.go !@gen/** node_modules/\\@types/** {\nindir: @src\n}\n" +
+		"@confdir/web/** {\n@web = web\nindir: @confdir/@web\n}\n"
+	ret, err := ParseWithOptions("dir/ppow.conf", text, Options{
+		Variables: map[string]string{"@src": "services/db"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"services/db/**/*.go", "node_modules/@types/**"}, ret.Blocks[0].Include); diff != "" {
+		t.Error(diff)
+	}
+	if diff := cmp.Diff([]string{"services/db/gen/**"}, ret.Blocks[0].Exclude); diff != "" {
+		t.Error(diff)
+	}
+	if ret.Blocks[0].InDir != mustAbs("services/db") {
+		t.Errorf("Unexpected indir %q", ret.Blocks[0].InDir)
+	}
+	if diff := cmp.Diff([]string{"dir/web/**"}, ret.Blocks[1].Include); diff != "" {
+		t.Error(diff)
+	}
+	if ret.Blocks[1].InDir != mustAbs("dir/web") {
+		t.Errorf("Unexpected indir %q", ret.Blocks[1].InDir)
+	}
+}
+
+func TestParseRoot(t *testing.T) {
+	root := mustAbs("dir")
+	text := "@here = $(pwd)\nsrc/** @confdir/web/** {\nindir: web\n}\n/abs/** {}\n"
+	eval := func(shell string, dir string, command string) (string, error) {
+		return dir, nil
+	}
+	ret, err := ParseWithOptions("dir/ppow.conf", text, Options{Root: "dir", Eval: eval})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := ret.GetVariables()["@confdir"]; v != filepath.ToSlash(root) {
+		t.Errorf("Unexpected @confdir %q", v)
+	}
+	if v := ret.GetVariables()["@here"]; v != root {
+		t.Errorf("Expected computed variables to run in the root, got %q", v)
+	}
+	if diff := cmp.Diff([]string{"src/**", "web/**"}, ret.Blocks[0].Include); diff != "" {
+		t.Error(diff)
+	}
+	if ret.Blocks[0].InDir != filepath.Join(root, "web") {
+		t.Errorf("Unexpected indir %q", ret.Blocks[0].InDir)
+	}
+	if diff := cmp.Diff([]string{"/abs/**"}, ret.Blocks[1].Include); diff != "" {
+		t.Error(diff)
+	}
+	for _, b := range ret.Blocks {
+		if b.Root != root {
+			t.Errorf("Unexpected root %q", b.Root)
+		}
+	}
+}
+
+func TestParseConditions(t *testing.T) {
+	text := fmt.Sprintf(`@docker ?= 0
+a +os=%[1]s,plan9 {
+    prep +os=!%[1]s: skipped
+    prep +arch=%[2]s: arch
+    daemon +if=@docker: docker
+    daemon +if=!@docker: local
+}
+b +os=!%[1]s {
+    prep: other
+}
+c +if=@docker {
+    prep: container
+}
+d {
+    @local = yes
+    prep +if=@local: local
+    prep +if=!@local: remote
+}
+`, runtime.GOOS, runtime.GOARCH)
+	ret, err := Parse("", text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"a", "d"}, ret.IncludePatterns()); diff != "" {
+		t.Error(diff)
+	}
+	a := ret.Blocks[0]
+	if len(a.Preps) != 1 || a.Preps[0].Command != "arch" {
+		t.Errorf("Unexpected preps %v", a.Preps)
+	}
+	if len(a.Daemons) != 1 || a.Daemons[0].Command != "local" {
+		t.Errorf("Unexpected daemons %v", a.Daemons)
+	}
+	if d := ret.Blocks[1]; len(d.Preps) != 1 || d.Preps[0].Command != "local" {
+		t.Errorf("Unexpected preps %v", d.Preps)
+	}
+
+	ret, err = ParseWithOptions("", text, Options{Variables: map[string]string{"@docker": "true"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"a", "c", "d"}, ret.IncludePatterns()); diff != "" {
+		t.Error(diff)
+	}
+	if ret.Blocks[0].Daemons[0].Command != "docker" {
+		t.Errorf("Unexpected daemons %v", ret.Blocks[0].Daemons)
+	}
+}
+
+func TestParseConditionalNames(t *testing.T) {
+	text := fmt.Sprintf(`a +os=%[1]s {
+    name: build
+    prep: here
+}
+b +os=!%[1]s {
+    name: build
+    prep: elsewhere
+}
+`, runtime.GOOS)
+	ret, err := Parse("", text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ret.Blocks) != 1 || ret.Blocks[0].Preps[0].Command != "here" {
+		t.Errorf("Unexpected blocks %v", ret.Blocks)
+	}
+
+	text = fmt.Sprintf("a +os=%[1]s {\nname: build\n}\nb {\nname: build\n}\n", runtime.GOOS)
+	_, err = Parse("test", text)
+	if err == nil || err.Error() != "test:4: duplicate block name: build" {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestParseProfiles(t *testing.T) {
+	text := `@api ?= localhost
+common {
+    prep: echo @api
+}
+profile full +default {
+    api {
+        name: server
+        daemon: ./server
+    }
+}
+profile frontend {
+    @api = staging.example.com
+    web {
+        name: server
+        daemon: ./web @api
+    }
+}
+profile ci {}
+`
+	ret, err := Parse("", text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"full", "frontend", "ci"}, ret.Profiles); diff != "" {
+		t.Error(diff)
+	}
+	if ret.DefaultProfile != "full" || ret.Profile != "full" {
+		t.Errorf("Unexpected profiles %q, %q", ret.DefaultProfile, ret.Profile)
+	}
+	if diff := cmp.Diff([]string{"api", "common"}, ret.IncludePatterns()); diff != "" {
+		t.Error(diff)
+	}
+	if ret.GetVariables()["@api"] != "localhost" {
+		t.Errorf("Unexpected variables %v", ret.GetVariables())
+	}
+
+	ret, err = ParseWithOptions("", text, Options{Profile: "frontend"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"common", "web"}, ret.IncludePatterns()); diff != "" {
+		t.Error(diff)
+	}
+	if ret.GetVariables()["@api"] != "staging.example.com" || ret.Profile != "frontend" {
+		t.Errorf("Unexpected variables %v", ret.GetVariables())
+	}
+
+	_, err = ParseWithOptions("test", text, Options{Profile: "nope"})
+	if err == nil || err.Error() != `test: unknown profile "nope", expected one of: full, frontend, ci` {
+		t.Errorf("Expected unknown profile error, got %v", err)
+	}
+	_, err = ParseWithOptions("test", "{}", Options{Profile: "nope"})
+	if err == nil || err.Error() != `test: unknown profile "nope": no profiles are declared` {
+		t.Errorf("Expected unknown profile error, got %v", err)
+	}
+	ret, err = ParseWithOptions("test", text, Options{Profile: "nope", ProfileFallback: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret.Profile != ret.DefaultProfile {
+		t.Errorf("Expected the default profile, got %q", ret.Profile)
+	}
+}
+
+func TestParseLines(t *testing.T) {
+	ret, err := Parse("test", "{\n}\n\n# comment\nfoo\nbar {\nprep: command\n}\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret.Blocks[0].Line != 1 || ret.Blocks[1].Line != 5 {
+		t.Errorf("Unexpected block lines %d, %d", ret.Blocks[0].Line, ret.Blocks[1].Line)
+	}
+}
+
 var parseErrorTests = []struct {
 	input string
 	err   string
 }{
-	{"{", "test:1: unterminated block"},
-	{"a", "test:1: expected block open parentheses, got \"\""},
-	{`foo { "bar": "bar" }`, "test:1: invalid input"},
-	{"foo { daemon: \n }", "test:1: empty command specification"},
-	{"foo { daemon: \" }", "test:1: unterminated quoted string"},
-	{"foo { daemon *: foo }", "test:1: invalid syntax"},
-	{"foo { daemon +invalid: foo }", "test:1: unknown signal: invalid"},
-	{"foo { prep +invalid: foo }", "test:1: unknown signal: +invalid"},
-	{"foo { prep +sigterm->sigbaa: foo }", "test:1: unknown signal: +sigterm->sigbaa"},
-	{"foo { prep +sigboo->sigusr1: foo }", "test:1: unknown signal: +sigboo->sigusr1"},
-	{"@foo bar {}", "test:1: Expected ="},
-	{"@foo =", "test:1: unterminated variable assignment"},
-	{"@foo=bar\n@foo=bar {}", "test:2: variable @foo shadows previous declaration"},
-	{"{indir +foo: bar\n}", "test:1: indir takes no options"},
-	{"{indir: bar\nindir: voing\n}", "test:2: indir can only be used once per block"},
+	{"{", "test:1:2: unterminated block (the block opened on line 1 needs a closing })"},
+	{"a", "test:1:2: expected block open parentheses, got \"\" (a block's patterns must be followed by {)"},
+	{`foo { "bar": "bar" }`, "test:1:7: invalid input"},
+	{"foo { daemon: \n }", "test:1:15: empty command specification"},
+	{"foo { daemon: \" }", "test:1:15: unterminated quoted string"},
+	{"foo { daemon *: foo }", "test:1:14: invalid command option"},
+	{"foo { daemon +invalid: foo }", "test:1:14: unknown signal: invalid\ntest:1:29: unterminated block (a } at the end of a command is part of the command; put it on a line of its own)"},
+	{"foo { prep +invalid: foo }", "test:1:12: unknown prep option: +invalid\ntest:1:27: unterminated block (a } at the end of a command is part of the command; put it on a line of its own)"},
+	{"foo { prep +sigterm->sigbaa: foo }", "test:1:12: unknown prep option: +sigterm->sigbaa (signal options only apply to daemons)\ntest:1:35: unterminated block (a } at the end of a command is part of the command; put it on a line of its own)"},
+	{"foo { prep +sigboo->sigusr1: foo }", "test:1:12: unknown prep option: +sigboo->sigusr1 (signal options only apply to daemons)\ntest:1:35: unterminated block (a } at the end of a command is part of the command; put it on a line of its own)"},
+	{"@foo bar {}", "test:1: unknown variable @foo in pattern \"@foo\""},
+	{"@foo\nbar {}", "test:1: unknown variable @foo in pattern \"@foo\""},
+	{"@a = x\n\nfoo !@b/** {}", "test:3: unknown variable @b in pattern \"@b/**\""},
+	{"@a = x\n{\nindir: @a/@b\n}", "test:2: unknown variable @b in indir"},
+	{"@a = x\n\nfoo +if=@b {}", "test:3: unknown variable @b in condition +if=@b"},
+	{"{\nprep +if=@b: foo\n}", "test:1: unknown variable @b in condition +if=@b"},
+	{"foo +os= {}", "test:1: empty condition: +os="},
+	{"{\nprep +os=linux +foo: foo\n}", "test:2:16: unknown prep option: +foo"},
+	{"{\nprep +retry=x: foo\n}", "test:2:6: invalid retry count: x (use a count like +retry=3, or +retry=3,backoff=500ms)"},
+	{"{\nprep +retry=3,wait=1s: foo\n}", "test:2:6: unknown retry option: wait=1s (use a count like +retry=3, or +retry=3,backoff=500ms)"},
+	{"profile a {\n{}\n", "test:3:1: unterminated profile a (add a closing } for the profile)"},
+	{"profile a {\nprofile b {}\n}", "test:2:1: profiles can't be nested"},
+	{"profile a +default {}\nprofile b +default {}", "test:2:9: profile a is already the default"},
+	{"profile a +foo {}", "test:1:11: unknown profile option: +foo"},
+	{"profile {}", "test:1:9: profile needs a name"},
+	{"profile a {\n@b = 1\n@b = 2\n}", "test:3:1: variable @b shadows previous declaration"},
+	{"{\nname: a\n}\nprofile b {\n{\nname: a\n}\n}", "test:5:1: duplicate block name: a"},
+	{"@foo =", "test:1:7: unterminated variable assignment"},
+	{"@foo=bar\n@foo=bar {}", "test:2:1: variable @foo shadows previous declaration"},
+	{"{indir +foo: bar\n}", "test:1:8: indir takes no options"},
+	{"{indir: bar\nindir: voing\n}", "test:2:1: indir can only be used once per block"},
+	{"include ''", "test:1:9: include needs a path"},
+	{"foo +disable {}", "test:1:5: +disable can only be used in a local override file"},
+	{"{name +foo: bar\n}", "test:1:7: name takes no options"},
+	{"{name: bar\nname: voing\n}", "test:2:1: name can only be used once per block"},
+	{"{name: 'bar voing'\n}", "test:1:8: invalid block name: \"bar voing\""},
+	{"{name: bar\n}\n{name: bar\n}", "test:3:1: duplicate block name: bar"},
+	{"{\n@a = b\n@a = c\n}", "test:3:1: variable @a shadows previous declaration"},
+	{"@a = @b\n@b = @c\n@c = @a\n", "test:1: variable cycle: @a -> @b -> @c -> @a"},
+	{"@a = x\n@b = @b\n", "test:2: variable cycle: @b -> @b"},
+	{"{}\n{\n@a = @b\n@b = @a\n}", "test:2: variable cycle: @a -> @b -> @a"},
+	{"@a ?= b\n@a ?= c\n", "test:2:1: variable @a already has a default"},
+	{"{\n@a ?= b\n}", "test:2:1: default values can only be declared at the top level"},
+	{"@a = $( )\n", "test:1:6: empty command in variable @a"},
+	{"@a +ontrigger = b\n", "test:1:4: +ontrigger can only be used with a $(...) value"},
+	{"@a +foo = $(date)\n", "test:1:4: unknown variable option: +foo"},
+	{"{\n@a = $(date)\n}", "test:2:1: computed variables can only be declared at the top level"},
+	{"{\ndeamon: foo\n}", "test:2:1: unknown directive: deamon (did you mean daemon?)"},
+	{"{\nprep +onchnage: foo\n}", "test:2:6: unknown prep option: +onchnage (did you mean +onchange?)"},
+	{"{\nprep foo\n}", "test:2:6: expected : (put a colon between the directive and its value)"},
+	{"{\nprep: a\n{\n}", "test:3:1: unexpected { (blocks can't be nested; is a } missing?)"},
+	{"{\nprep: a\n}\n}", "test:4:1: unexpected } (remove it, or add the { it should close)"},
+	{"{\nprep: a\n", "test:3:1: unterminated block (the block opened on line 1 needs a closing })"},
+	{"@a +ontriger = $(date)\n", "test:1:4: unknown variable option: +ontriger (did you mean +ontrigger?)"},
+	{"profile a +defualt {}", "test:1:11: unknown profile option: +defualt (did you mean +default?)"},
+}
+
+func TestParseDiagnostics(t *testing.T) {
+	text := "@a = 1\n" +
+		"@a = 2\n" +
+		"{\n" +
+		"deamon: foo\n" +
+		"prep: ok\n" +
+		"prep +sigterm: bar\n" +
+		"}\n" +
+		"foo ! {}\n" +
+		"{\n" +
+		"name: b\n" +
+		"prep: baz\n"
+	_, err := Parse("test", text)
+	var perr *ParseError
+	if !errors.As(err, &perr) {
+		t.Fatalf("Expected a ParseError, got %v", err)
+	}
+	expected := []Diagnostic{
+		{"test", 2, 1, "@a", "variable @a shadows previous declaration", ""},
+		{"test", 4, 1, "deamon", "unknown directive: deamon", "did you mean daemon?"},
+		{"test", 6, 6, "+sigterm", "unknown prep option: +sigterm", "signal options only apply to daemons"},
+		{"test", 8, 5, "!", "! must be followed by a string", ""},
+		{"test", 12, 1, "", "unterminated block", "the block opened on line 9 needs a closing }"},
+	}
+	if diff := cmp.Diff(expected, perr.Diagnostics); diff != "" {
+		t.Error(diff)
+	}
+}
+
+// Parsing must terminate with an error, rather than hang or panic, however
+// the input is cut short
+func TestParseTruncated(t *testing.T) {
+	text := "@a = x\n" +
+		"@b +ontrigger = $(date)\n" +
+		"profile p +default {\n" +
+		"  @c = 'y'\n" +
+		"}\n" +
+		"**/*.go !vendor/** +os=linux {\n" +
+		"  name: build\n" +
+		"  indir: @a\n" +
+		"  @d = \"z\"\n" +
+		"  prep +onchange: go build\n" +
+		"  daemon +sigterm: \"./server\n  --port 80\"\n" +
+		"}\n" +
+		"include other.conf\n"
+	for i := range text {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			Parse("test", text[:i])
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Parsing %q doesn't terminate", text[:i])
+		}
+	}
 }
 
 func TestErrorsParse(t *testing.T) {
@@ -0,0 +1,404 @@
+package conf
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A File is the concrete syntax tree of a config file. Unlike Config, it keeps
+// comments, quoting and layout, so that the file can be written back out. It
+// describes the file as written: includes aren't read, and variables aren't
+// expanded.
+type File struct {
+	Name   string
+	Source string
+	Nodes  []Node
+}
+
+// A Token is a piece of the source text, exactly as written
+type Token struct {
+	Pos  Pos
+	Text string
+}
+
+// End returns the position just past the token
+func (t Token) End() Pos {
+	return t.Pos + Pos(len(t.Text))
+}
+
+// A Node is a statement of a config file, or a directive in the body of a
+// block. Nodes are *CommentGroup, *VarDecl, *IncludeStmt, *ProfileStmt,
+// *BlockStmt and *Directive.
+type Node interface {
+	// Start returns the position of the node's first token, not counting its
+	// comments
+	Start() Pos
+	decoration() *Decoration
+}
+
+// Decoration holds the layout and comments around a node
+type Decoration struct {
+	// Whether a blank line separates the node from the one before it
+	BlankBefore bool
+	// Comments on the lines just before the node
+	Comments []Token
+	// A comment at the end of the node's last line
+	LineComment *Token
+}
+
+func (d *Decoration) decoration() *Decoration {
+	return d
+}
+
+// A CommentGroup is a run of comments that isn't attached to a node, because a
+// blank line separates it from the next one, or because it ends a file or
+// body
+type CommentGroup struct {
+	Decoration
+}
+
+func (n *CommentGroup) Start() Pos {
+	return n.Comments[0].Pos
+}
+
+// A VarDecl is a variable declaration
+type VarDecl struct {
+	Decoration
+	Name    Token
+	Options []Token
+	// Op is = or ?=
+	Op Token
+	// Value includes quotes, if the value is quoted
+	Value Token
+}
+
+func (n *VarDecl) Start() Pos {
+	return n.Name.Pos
+}
+
+// An IncludeStmt includes another config file
+type IncludeStmt struct {
+	Decoration
+	Keyword Token
+	Path    Token
+}
+
+func (n *IncludeStmt) Start() Pos {
+	return n.Keyword.Pos
+}
+
+// Braces holds the braces around the body of a block or profile, and the
+// comments that belong to them
+type Braces struct {
+	Open Token
+	// A comment on the same line as the opening brace
+	OpenComment *Token
+	Close       Token
+}
+
+// A ProfileStmt is a profile section
+type ProfileStmt struct {
+	Decoration
+	Braces
+	Keyword Token
+	Name    Token
+	Options []Token
+	Body    []Node
+}
+
+func (n *ProfileStmt) Start() Pos {
+	return n.Keyword.Pos
+}
+
+// A BlockStmt is a block of commands
+type BlockStmt struct {
+	Decoration
+	Braces
+	// Patterns holds the watch patterns, exclusions and block options, in the
+	// order they were written
+	Patterns []Token
+	// Body holds *Directive, *VarDecl and *CommentGroup nodes
+	Body []Node
+}
+
+func (n *BlockStmt) Start() Pos {
+	if len(n.Patterns) > 0 {
+		return n.Patterns[0].Pos
+	}
+	return n.Open.Pos
+}
+
+// A Directive is an indir, name, prep or daemon line in a block
+type Directive struct {
+	Decoration
+	Keyword Token
+	Options []Token
+	// Value includes quotes, if the value is quoted
+	Value Token
+}
+
+func (n *Directive) Start() Pos {
+	return n.Keyword.Pos
+}
+
+// ParseSyntax parses a config file into its syntax tree. It only checks the
+// syntax of the file: includes aren't read, and variables aren't resolved.
+func ParseSyntax(name string, text string) (*File, error) {
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	b := &syntaxBuilder{file: &File{Name: name, Source: text}}
+	l := lex(name, text)
+	for {
+		itm := l.nextItem()
+		switch itm.typ {
+		case itemSpace:
+			continue
+		case itemError:
+			b.errorAt(itm, itm.hint, "%s", itm.val)
+			continue
+		}
+		b.items = append(b.items, itm)
+		if itm.typ == itemEOF {
+			break
+		}
+	}
+	if !b.failed() {
+		b.try(func() {
+			b.file.Nodes = b.nodes(false)
+			b.expect(itemEOF)
+		})
+	}
+	if b.failed() {
+		return nil, &ParseError{b.diagnostics}
+	}
+	return b.file, nil
+}
+
+// syntaxBuilder builds a syntax tree from the lexer's items
+type syntaxBuilder struct {
+	file        *File
+	items       []item
+	diagnostics []Diagnostic
+	// The end of the last token consumed
+	last Pos
+}
+
+func (b *syntaxBuilder) errorAt(itm item, hint string, format string, args ...interface{}) {
+	d := newDiagnostic(b.file.Name, b.file.Source, itm, hint, fmt.Sprintf(format, args...))
+	b.diagnostics = append(b.diagnostics, d)
+}
+
+func (b *syntaxBuilder) errorf(format string, args ...interface{}) {
+	b.errorAt(b.peek(), "", format, args...)
+	panic(bailout{})
+}
+
+func (b *syntaxBuilder) failed() bool {
+	return len(b.diagnostics) > 0
+}
+
+func (b *syntaxBuilder) try(step func()) {
+	defer func() {
+		if e := recover(); e != nil {
+			if _, ok := e.(bailout); !ok {
+				panic(e)
+			}
+		}
+	}()
+	step()
+}
+
+func (b *syntaxBuilder) peek() item {
+	return b.items[0]
+}
+
+// next consumes the next item, and returns it as a token
+func (b *syntaxBuilder) next() Token {
+	itm := b.items[0]
+	if itm.typ != itemEOF {
+		b.items = b.items[1:]
+	}
+	t := Token{Pos: itm.pos, Text: strings.TrimRight(itm.val, whitespace)}
+	b.last = t.End()
+	return t
+}
+
+func (b *syntaxBuilder) expect(typ itemType) Token {
+	if b.peek().typ != typ {
+		b.errorf("expected %s, got %s", typ, b.peek().typ)
+	}
+	return b.next()
+}
+
+func (b *syntaxBuilder) collect(typ itemType) []Token {
+	var ret []Token
+	for b.peek().typ == typ {
+		ret = append(ret, b.next())
+	}
+	return ret
+}
+
+// blankBefore checks whether there's a blank line between the last token and
+// the next one
+func (b *syntaxBuilder) blankBefore() bool {
+	return strings.Count(b.file.Source[b.last:b.peek().pos], "\n") > 1
+}
+
+// sameLine checks whether the next item is on the same line as the last token
+func (b *syntaxBuilder) sameLine() bool {
+	return !strings.Contains(b.file.Source[b.last:b.peek().pos], "\n")
+}
+
+// lineComment consumes a comment on the same line as the last token
+func (b *syntaxBuilder) lineComment() *Token {
+	if b.peek().typ == itemComment && b.sameLine() {
+		t := b.next()
+		return &t
+	}
+	return nil
+}
+
+// decoration consumes the comments before a node. If a blank line separates
+// the comments from the node, or there's no node, they form a CommentGroup,
+// which is returned instead.
+func (b *syntaxBuilder) decoration(inBody bool) (Decoration, *CommentGroup) {
+	d := Decoration{BlankBefore: b.blankBefore()}
+	for b.peek().typ == itemComment {
+		d.Comments = append(d.Comments, b.next())
+		if b.peek().typ == itemComment && b.blankBefore() {
+			return d, &CommentGroup{d}
+		}
+	}
+	if len(d.Comments) > 0 && (b.blankBefore() || b.atEnd(inBody)) {
+		return d, &CommentGroup{d}
+	}
+	return d, nil
+}
+
+// atEnd checks whether we're at the end of the file, or of the body of a
+// block or profile
+func (b *syntaxBuilder) atEnd(inBody bool) bool {
+	switch b.peek().typ {
+	case itemEOF:
+		return true
+	case itemRightParen:
+		return inBody
+	}
+	return false
+}
+
+// nodes parses top-level statements, up to the end of the file, or the end of
+// a profile if inProfile is set
+func (b *syntaxBuilder) nodes(inProfile bool) []Node {
+	var ret []Node
+	for !b.atEnd(inProfile) {
+		d, group := b.decoration(inProfile)
+		if group != nil {
+			ret = append(ret, group)
+			continue
+		}
+		var n Node
+		switch b.peek().typ {
+		case itemVarName:
+			n = b.varDecl(d)
+		case itemInclude:
+			n = &IncludeStmt{
+				Decoration: d,
+				Keyword:    b.next(),
+				Path:       b.expectValue(),
+			}
+			n.decoration().LineComment = b.lineComment()
+		case itemProfile:
+			n = b.profile(d)
+		default:
+			n = b.block(d)
+		}
+		ret = append(ret, n)
+	}
+	return ret
+}
+
+func (b *syntaxBuilder) expectValue() Token {
+	if t := b.peek().typ; t != itemBareString && t != itemQuotedString {
+		b.errorf("expected a value, got %s", t)
+	}
+	return b.next()
+}
+
+func (b *syntaxBuilder) varDecl(d Decoration) *VarDecl {
+	n := &VarDecl{Decoration: d, Name: b.next()}
+	n.Options = b.collect(itemBareString)
+	if t := b.peek().typ; t != itemEquals && t != itemDefaultEquals {
+		b.errorf("expected =, got %s", t)
+	}
+	n.Op = b.next()
+	n.Value = b.expectValue()
+	n.LineComment = b.lineComment()
+	return n
+}
+
+// braces parses the body of a block or profile, with the given function
+// parsing the nodes in it
+func (b *syntaxBuilder) braces(body func() []Node) (Braces, []Node) {
+	var br Braces
+	br.Open = b.expect(itemLeftParen)
+	br.OpenComment = b.lineComment()
+	nodes := body()
+	br.Close = b.expect(itemRightParen)
+	return br, nodes
+}
+
+func (b *syntaxBuilder) profile(d Decoration) *ProfileStmt {
+	n := &ProfileStmt{Decoration: d, Keyword: b.next()}
+	n.Name = b.expect(itemBareString)
+	n.Options = b.collect(itemBareString)
+	n.Braces, n.Body = b.braces(func() []Node { return b.nodes(true) })
+	n.LineComment = b.lineComment()
+	return n
+}
+
+func (b *syntaxBuilder) block(d Decoration) *BlockStmt {
+	n := &BlockStmt{Decoration: d}
+	for {
+		switch b.peek().typ {
+		case itemBareString, itemQuotedString:
+			n.Patterns = append(n.Patterns, b.next())
+			continue
+		case itemComment:
+			// Comments between the patterns move above the block
+			n.Comments = append(n.Comments, b.next())
+			continue
+		}
+		break
+	}
+	n.Braces, n.Body = b.braces(b.directives)
+	n.LineComment = b.lineComment()
+	return n
+}
+
+// directives parses the body of a block
+func (b *syntaxBuilder) directives() []Node {
+	var ret []Node
+	for !b.atEnd(true) {
+		d, group := b.decoration(true)
+		if group != nil {
+			ret = append(ret, group)
+			continue
+		}
+		var n Node
+		switch b.peek().typ {
+		case itemVarName:
+			n = b.varDecl(d)
+		case itemInDir, itemName, itemPrep, itemDaemon:
+			dir := &Directive{Decoration: d, Keyword: b.next()}
+			dir.Options = b.collect(itemBareString)
+			b.expect(itemColon)
+			dir.Value = b.expectValue()
+			dir.LineComment = b.lineComment()
+			n = dir
+		default:
+			b.errorf("unexpected %s", b.peek().typ)
+		}
+		ret = append(ret, n)
+	}
+	return ret
+}
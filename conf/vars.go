@@ -0,0 +1,240 @@
+package conf
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Variable references, including references to the environment with an
+// optional default, like @env.NAME:-default. The default runs to the next
+// whitespace or quote.
+var varName = regexp.MustCompile(`(\\*)@(env\.\w+(:-[^\s"'` + "`" + `]*)?|\w+)`)
+
+const envPrefix = "@env."
+
+const esc = '\\'
+
+// Expand replaces the variable references in s with the values returned by
+// lookup. A backslash before the @ marker escapes the reference, and
+// backslashes preceding the marker can themselves be escaped. References to
+// the environment are resolved from the environment of the current process.
+func Expand(s string, lookup func(name string) (string, error)) (string, error) {
+	var err error
+	s = varName.ReplaceAllStringFunc(
+		s,
+		func(key string) string {
+			if err != nil {
+				return ""
+			}
+			cnt := 0
+			for _, c := range key {
+				if c != esc {
+					break
+				}
+				cnt++
+			}
+			ks := strings.TrimLeft(key, string(esc))
+			if cnt%2 != 0 {
+				return strings.Repeat(string(esc), (cnt-1)/2) + ks
+			}
+			var val string
+			var errv error
+			if strings.HasPrefix(ks, envPrefix) {
+				val, errv = lookupEnv(ks, lookup)
+			} else {
+				val, errv = lookup(ks)
+			}
+			if errv != nil {
+				err = errv
+				return ""
+			}
+			return strings.Repeat(string(esc), cnt/2) + val
+		},
+	)
+	if err != nil {
+		return "", err
+	}
+	return s, nil
+}
+
+// escape escapes the variable references in s, so that Expand returns s as it
+// is.
+func escape(s string) string {
+	return varName.ReplaceAllStringFunc(s, func(key string) string {
+		ks := strings.TrimLeft(key, string(esc))
+		cnt := len(key) - len(ks)
+		return strings.Repeat(string(esc), 2*cnt+1) + ks
+	})
+}
+
+// lookupEnv resolves a reference of the form @env.NAME or
+// @env.NAME:-default. The default may itself contain variable references,
+// which are expanded with lookup.
+func lookupEnv(ref string, lookup func(name string) (string, error)) (string, error) {
+	name := strings.TrimPrefix(ref, envPrefix)
+	name, def, hasDefault := strings.Cut(name, ":-")
+	// As in the shell, the default also replaces an empty value
+	if v, ok := os.LookupEnv(name); ok && (v != "" || !hasDefault) {
+		return v, nil
+	}
+	if !hasDefault {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return Expand(def, lookup)
+}
+
+// A resolver recursively expands variable values
+type resolver struct {
+	// Unexpanded values
+	raw map[string]string
+	// Values of variables from an enclosing scope, which are already expanded
+	outer map[string]string
+	// Values that are used as they are, like the output of commands that have
+	// already been run
+	fixed map[string]string
+	// Variables whose value is the output of a command, which is run with
+	// eval. If eval is nil, the raw value is used instead.
+	commands map[string]command
+	eval     EvalFunc
+	// dir is the directory the commands run in
+	dir string
+
+	done  map[string]string
+	stack []string
+}
+
+// A command is the $(...) value of a computed variable
+type command struct {
+	text string
+	// Re-run the command every time a block is triggered
+	perTrigger bool
+}
+
+// EvalFunc runs the command of a computed variable with the given shell in
+// the directory dir, and returns its output. The shell is empty if @shell
+// isn't set, and dir is empty for the current directory.
+type EvalFunc func(shell string, dir string, command string) (string, error)
+
+// VariableError is returned when the value of a variable can't be computed,
+// for instance because its command failed
+type VariableError struct {
+	Name string
+	Err  error
+}
+
+func (e *VariableError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Name, e.Err)
+}
+
+// CycleError is returned when variables refer to each other in a loop
+type CycleError struct {
+	// Chain lists the variables in the loop, starting and ending with the
+	// same variable
+	Chain []string
+}
+
+func (e *CycleError) Error() string {
+	return "variable cycle: " + strings.Join(e.Chain, " -> ")
+}
+
+func (r *resolver) resolve(name string) (string, error) {
+	if v, ok := r.done[name]; ok {
+		return v, nil
+	}
+	if v, ok := r.fixed[name]; ok {
+		r.done[name] = v
+		return v, nil
+	}
+	raw, ok := r.raw[name]
+	if !ok {
+		if v, ok := r.outer[name]; ok {
+			return v, nil
+		}
+		// Unknown references are left as they are. The command renderer
+		// expands the references to @mods and @dirmods in values.
+		return name, nil
+	}
+	for i, v := range r.stack {
+		if v == name {
+			chain := append(append([]string{}, r.stack[i:]...), name)
+			return "", &CycleError{chain}
+		}
+	}
+	r.stack = append(r.stack, name)
+	var val string
+	var err error
+	if cmd, ok := r.commands[name]; ok && r.eval != nil {
+		val, err = r.run(cmd)
+	} else {
+		val, err = Expand(raw, r.resolve)
+	}
+	r.stack = r.stack[:len(r.stack)-1]
+	if err != nil {
+		switch err.(type) {
+		case *CycleError, *VariableError:
+		default:
+			err = &VariableError{name, err}
+		}
+		return "", err
+	}
+	r.done[name] = val
+	return val, nil
+}
+
+// run expands the variable references in a command, and runs it with the
+// configured shell
+func (r *resolver) run(cmd command) (string, error) {
+	shell := ""
+	if _, ok := r.raw[shellVarName]; ok {
+		var err error
+		if shell, err = r.resolve(shellVarName); err != nil {
+			return "", err
+		}
+	}
+	text, err := Expand(cmd.text, r.resolve)
+	if err != nil {
+		return "", err
+	}
+	return r.eval(shell, r.dir, text)
+}
+
+// resolveAll expands references in all values of raw. References to names
+// not in raw are looked up in outer, and left as they are if they aren't
+// found there either.
+func resolveAll(raw map[string]string, outer map[string]string) (map[string]string, error) {
+	r := &resolver{raw: raw, outer: outer}
+	return r.all()
+}
+
+// allOrRaw resolves every variable in r.raw. Cycles are reported by Parse,
+// so this can't fail for a parsed config; if it does, the unexpanded values
+// are returned.
+func (r *resolver) allOrRaw() map[string]string {
+	n, err := r.all()
+	if err != nil {
+		n = map[string]string{}
+		for k, v := range r.raw {
+			n[k] = v
+		}
+	}
+	return n
+}
+
+// all resolves every variable in r.raw
+func (r *resolver) all() (map[string]string, error) {
+	r.done = map[string]string{}
+	names := make([]string, 0, len(r.raw))
+	for k := range r.raw {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		if _, err := r.resolve(k); err != nil {
+			return nil, err
+		}
+	}
+	return r.done, nil
+}
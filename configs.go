@@ -0,0 +1,73 @@
+package ppow
+
+import (
+	"io/fs"
+	"path"
+	"path/filepath"
+
+	"github.com/cortesi/moddwatch/filter"
+	"github.com/dottedmag/ppow/conf"
+	"github.com/dottedmag/termlog"
+)
+
+// ConfName is the name of the config files found in subdirectories with
+// Options.Recursive
+const ConfName = "ppow.conf"
+
+// configFile is one of the configs a ModRunner runs. Each config keeps its
+// own variables and root, and logs with its own prefix.
+type configFile struct {
+	path string
+	// root is the directory the config's paths are relative to, or empty for
+	// the current directory
+	root   string
+	log    termlog.TermLog
+	config *conf.Config
+}
+
+// findConfigs walks the current directory for config files named ConfName,
+// skipping directories the common excludes ignore. Parent directories come
+// before their subdirectories.
+func findConfigs() ([]string, error) {
+	var ret []string
+	err := filepath.WalkDir(".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if p == "." {
+				return nil
+			}
+			if m, _ := filter.MatchAny(path.Join(filepath.ToSlash(p), "x"), CommonExcludes); m {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Name() == ConfName {
+			ret = append(ret, p)
+		}
+		return nil
+	})
+	return ret, err
+}
+
+// prefixLog prefixes the headers of a log's streams, so that the commands of
+// different configs can be told apart
+type prefixLog struct {
+	termlog.TermLog
+	prefix string
+}
+
+func (l *prefixLog) Stream(header string) termlog.Stream {
+	return l.TermLog.Stream(termlog.DefaultPalette.Timestamp.SprintFunc()(l.prefix) + header)
+}
+
+// seen reports whether a config is already among those to run
+func seen(files []*configFile, confPath string) bool {
+	for _, f := range files {
+		if conf.SamePath(f.path, confPath) {
+			return true
+		}
+	}
+	return false
+}
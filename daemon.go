@@ -135,18 +135,17 @@ type DaemonPen struct {
 
 // NewDaemonPen creates a new DaemonPen
 func NewDaemonPen(block conf.Block, vars map[string]string, log termlog.TermLog) (*DaemonPen, error) {
+	vars = block.Scope(vars)
 	d := make([]*daemon, len(block.Daemons))
 	for i, dmn := range block.Daemons {
 		vcmd := VarCmd{Block: nil, Modified: nil, Vars: vars}
 		finalcmd, err := vcmd.Render(dmn.Command)
 		if err != nil {
-			return nil, err
+			return nil, blockError(&block, err)
 		}
 		dmn.Command = finalcmd
-		var indir string
-		if block.InDir != "" {
-			indir = block.InDir
-		} else {
+		indir := blockDir(&block)
+		if indir == "" {
 			indir, err = os.Getwd()
 			if err != nil {
 				return nil, err
@@ -154,12 +153,12 @@ func NewDaemonPen(block conf.Block, vars map[string]string, log termlog.TermLog)
 		}
 		sh, err := GetShellName(vars[shellVarName])
 		if err != nil {
-			return nil, err
+			return nil, blockError(&block, err)
 		}
 
 		d[i] = &daemon{
 			conf:  dmn,
-			log:   log.Stream(niceHeader("daemon: ", dmn.Command)),
+			log:   log.Stream(niceHeader(blockPreamble(&block, "daemon: "), dmn.Command)),
 			shell: sh,
 			indir: indir,
 		}
@@ -202,6 +201,9 @@ func (dp *DaemonPen) Signal(sig os.Signal) {
 // DaemonWorld represents the entire world of daemons
 type DaemonWorld struct {
 	DaemonPens []*DaemonPen
+
+	// Guards DaemonPens while pens are replaced
+	sync.Mutex
 }
 
 // NewDaemonWorld creates a DaemonWorld
@@ -215,17 +217,32 @@ func NewDaemonWorld(cnf *conf.Config, log termlog.TermLog) (*DaemonWorld, error)
 		daemonPens[i] = d
 
 	}
-	return &DaemonWorld{daemonPens}, nil
+	return &DaemonWorld{DaemonPens: daemonPens}, nil
+}
+
+// replace swaps n pens from index start on for others, and returns the pens
+// that were replaced
+func (dw *DaemonWorld) replace(start int, n int, pens []*DaemonPen) []*DaemonPen {
+	dw.Lock()
+	defer dw.Unlock()
+	old := append([]*DaemonPen{}, dw.DaemonPens[start:start+n]...)
+	rest := append(append([]*DaemonPen{}, pens...), dw.DaemonPens[start+n:]...)
+	dw.DaemonPens = append(dw.DaemonPens[:start], rest...)
+	return old
 }
 
 // Shutdown all daemons with signal s
 func (dw *DaemonWorld) Shutdown(s os.Signal) {
+	dw.Lock()
+	defer dw.Unlock()
 	for _, dp := range dw.DaemonPens {
 		dp.Shutdown(s)
 	}
 }
 
 func (dw *DaemonWorld) Signal(s os.Signal) {
+	dw.Lock()
+	defer dw.Unlock()
 	for _, dp := range dw.DaemonPens {
 		dp.Signal(s)
 	}
@@ -4,6 +4,8 @@ import (
 	"bufio"
 	"io"
 	"sync"
+
+	"github.com/dottedmag/termlog"
 )
 
 func logOutput(wg *sync.WaitGroup, fp io.ReadCloser, out func(string, ...interface{})) {
@@ -17,3 +19,67 @@ func logOutput(wg *sync.WaitGroup, fp io.ReadCloser, out func(string, ...interfa
 		out("%s", string(line))
 	}
 }
+
+// bufferedStream holds the lines logged to it until they're flushed to
+// another stream, so that commands running at the same time don't interleave
+// their output
+type bufferedStream struct {
+	sync.Mutex
+	lines []func(termlog.Stream)
+}
+
+func (s *bufferedStream) add(f func(termlog.Stream)) {
+	s.Lock()
+	defer s.Unlock()
+	s.lines = append(s.lines, f)
+}
+
+// flush logs everything held so far to a stream
+func (s *bufferedStream) flush(to termlog.Stream) {
+	s.Lock()
+	defer s.Unlock()
+	for _, f := range s.lines {
+		f(to)
+	}
+	s.lines = nil
+}
+
+func (s *bufferedStream) Say(format string, args ...interface{}) {
+	s.add(func(l termlog.Stream) { l.Say(format, args...) })
+}
+
+func (s *bufferedStream) Notice(format string, args ...interface{}) {
+	s.add(func(l termlog.Stream) { l.Notice(format, args...) })
+}
+
+func (s *bufferedStream) Warn(format string, args ...interface{}) {
+	s.add(func(l termlog.Stream) { l.Warn(format, args...) })
+}
+
+func (s *bufferedStream) Shout(format string, args ...interface{}) {
+	s.add(func(l termlog.Stream) { l.Shout(format, args...) })
+}
+
+func (s *bufferedStream) SayAs(name string, format string, args ...interface{}) {
+	s.add(func(l termlog.Stream) { l.SayAs(name, format, args...) })
+}
+
+func (s *bufferedStream) NoticeAs(name string, format string, args ...interface{}) {
+	s.add(func(l termlog.Stream) { l.NoticeAs(name, format, args...) })
+}
+
+func (s *bufferedStream) WarnAs(name string, format string, args ...interface{}) {
+	s.add(func(l termlog.Stream) { l.WarnAs(name, format, args...) })
+}
+
+func (s *bufferedStream) ShoutAs(name string, format string, args ...interface{}) {
+	s.add(func(l termlog.Stream) { l.ShoutAs(name, format, args...) })
+}
+
+func (s *bufferedStream) Quiet() {
+	s.add(func(l termlog.Stream) { l.Quiet() })
+}
+
+func (s *bufferedStream) Header() {
+	s.add(func(l termlog.Stream) { l.Header() })
+}
@@ -0,0 +1,119 @@
+package lsp
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/dottedmag/ppow/conf"
+)
+
+// Variables that are always available, and what they hold
+var builtinVariables = map[string]string{
+	"@confdir": "the directory of the config file",
+}
+
+// Variables that are available to commands, and what they hold
+var commandVariables = map[string]string{
+	"@mods":    "the files that changed",
+	"@dirmods": "the directories of the files that changed",
+}
+
+// Variable declarations. Declarations start a line.
+var declaration = regexp.MustCompile(`(?m)^[ \t]*(@\w+)[^=\n]*\??=[ \t]*(.*)$`)
+
+// Characters that end the word being completed
+const wordBreaks = " \t\n\"'`$(){}|&;<>"
+
+// complete returns the completions for the word before a position
+func (d *document) complete(pos Position) []CompletionItem {
+	off := d.offset(pos)
+	lineStart := strings.LastIndexByte(d.text[:off], '\n') + 1
+	wordStart := strings.LastIndexAny(d.text[lineStart:off], wordBreaks) + 1 + lineStart
+	word := d.text[wordStart:off]
+	ctx := conf.ContextAt(d.text, conf.Pos(off))
+
+	if at := strings.LastIndexByte(word, '@'); at >= 0 {
+		return d.items(wordStart+at, off, kindVariable, d.variables(ctx))
+	}
+	if ctx.InValue {
+		return []CompletionItem{}
+	}
+	if strings.HasPrefix(word, "+") {
+		var options []string
+		switch ctx.Directive {
+		case "daemon":
+			options = conf.DaemonOptions
+		case "prep":
+			options = conf.PrepOptions
+		case "":
+			if !ctx.InBlock {
+				options = statementOptions(strings.TrimSpace(d.text[lineStart:wordStart]))
+			}
+		}
+		return d.items(wordStart, off, kindProperty, details(options))
+	}
+	if ctx.InBlock && ctx.Directive == "" && strings.TrimSpace(d.text[lineStart:wordStart]) == "" {
+		return d.items(wordStart, off, kindKeyword, details(conf.Directives))
+	}
+	return []CompletionItem{}
+}
+
+// statementOptions returns the options of the statement on a line outside a
+// block, given the text before the option being written
+func statementOptions(before string) []string {
+	switch {
+	case strings.HasPrefix(before, "@"):
+		return []string{"+ontrigger"}
+	case strings.HasPrefix(before, "profile "):
+		return []string{"+default"}
+	case strings.HasPrefix(before, "include "):
+		return nil
+	}
+	return conf.BlockOptions
+}
+
+// variables returns the variables that can be referred to in a context,
+// mapped to their values or descriptions. The document is usually
+// incomplete while it's being edited, so declarations are found by their
+// look rather than by parsing.
+func (d *document) variables(ctx conf.Context) map[string]string {
+	ret := map[string]string{}
+	for k, v := range builtinVariables {
+		ret[k] = v
+	}
+	if ctx.InBlock {
+		for k, v := range commandVariables {
+			ret[k] = v
+		}
+	}
+	for _, m := range declaration.FindAllStringSubmatch(d.text, -1) {
+		ret[m[1]] = strings.TrimSpace(m[2])
+	}
+	return ret
+}
+
+func details(words []string) map[string]string {
+	ret := make(map[string]string, len(words))
+	for _, w := range words {
+		ret[w] = ""
+	}
+	return ret
+}
+
+// items returns completions that replace the text between two offsets,
+// sorted by label
+func (d *document) items(start int, end int, kind int, words map[string]string) []CompletionItem {
+	ret := []CompletionItem{}
+	span := d.span(start, end)
+	for w, detail := range words {
+		ret = append(ret, CompletionItem{
+			Label:    w,
+			Kind:     kind,
+			Detail:   detail,
+			TextEdit: &TextEdit{Range: span, NewText: w},
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Label < ret[j].Label })
+	return ret
+}
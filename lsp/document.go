@@ -0,0 +1,160 @@
+package lsp
+
+import (
+	"net/url"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/dottedmag/ppow/conf"
+)
+
+// document is an open config file
+type document struct {
+	uri string
+	// The text, with Windows line endings replaced, as the parser sees it
+	text string
+	// path is the path of the file, or an empty string if the document isn't
+	// a file on disk
+	path string
+}
+
+func newDocument(uri string, text string) *document {
+	return &document{
+		uri:  uri,
+		text: strings.Replace(text, "\r\n", "\n", -1),
+		path: uriPath(uri),
+	}
+}
+
+// uriPath returns the path of a file: URI, or an empty string for other URIs
+func uriPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return ""
+	}
+	p := u.Path
+	// file:///C:/dir has the path /C:/dir
+	if runtime.GOOS == "windows" && len(p) > 2 && p[0] == '/' && p[2] == ':' {
+		p = p[1:]
+	}
+	return filepath.FromSlash(p)
+}
+
+// name is the name the config is parsed under. Includes are resolved relative
+// to it, and problems in the document itself are reported under it.
+func (d *document) name() string {
+	if d.path == "" {
+		return d.uri
+	}
+	return d.path
+}
+
+// parse parses the document. Variables with a $(...) value aren't evaluated:
+// we don't run commands while the user types.
+func (d *document) parse() (*conf.Config, error) {
+	return conf.Parse(d.name(), d.text)
+}
+
+// offset returns the byte offset of a position. Positions past the end of a
+// line are clamped to its end.
+func (d *document) offset(pos Position) int {
+	off := 0
+	for i := 0; i < pos.Line; i++ {
+		nl := strings.IndexByte(d.text[off:], '\n')
+		if nl < 0 {
+			return len(d.text)
+		}
+		off += nl + 1
+	}
+	for units := 0; units < pos.Character && off < len(d.text); {
+		r, size := utf8.DecodeRuneInString(d.text[off:])
+		if r == '\n' {
+			break
+		}
+		units++
+		if r >= 0x10000 {
+			// Encoded as a surrogate pair
+			units++
+		}
+		off += size
+	}
+	return off
+}
+
+// position returns the position of a byte offset
+func (d *document) position(off int) Position {
+	before := d.text[:off]
+	start := strings.LastIndexByte(before, '\n') + 1
+	return Position{
+		Line:      strings.Count(before, "\n"),
+		Character: len(utf16.Encode([]rune(before[start:]))),
+	}
+}
+
+// span returns the range of the text between two byte offsets
+func (d *document) span(start int, end int) Range {
+	return Range{d.position(start), d.position(end)}
+}
+
+// lineSpan returns the range of a 0-based line, without its line break
+func (d *document) lineSpan(line int) Range {
+	start := d.offset(Position{Line: line})
+	end := start + strings.IndexByte(d.text[start:]+"\n", '\n')
+	return d.span(start, end)
+}
+
+// diagnostics parses the document, and returns the problems found
+func (d *document) diagnostics() []Diagnostic {
+	ret := []Diagnostic{}
+	_, err := d.parse()
+	if err == nil {
+		return ret
+	}
+	perr, ok := err.(*conf.ParseError)
+	if !ok {
+		return append(ret, Diagnostic{
+			Range:    d.lineSpan(0),
+			Severity: severityError,
+			Source:   "ppow",
+			Message:  err.Error(),
+		})
+	}
+	for _, pd := range perr.Diagnostics {
+		ret = append(ret, d.diagnostic(pd))
+	}
+	return ret
+}
+
+// diagnostic converts a problem found by the parser
+func (d *document) diagnostic(pd conf.Diagnostic) Diagnostic {
+	ret := Diagnostic{Severity: severityError, Source: "ppow", Message: pd.Message}
+	if pd.Suggestion != "" {
+		ret.Message += " (" + pd.Suggestion + ")"
+	}
+	switch {
+	case pd.File != d.name():
+		// Problems in included files are shown at the top of the document
+		ret.Range = d.lineSpan(0)
+		ret.Message = pd.Error()
+	case pd.Line == 0:
+		ret.Range = d.lineSpan(0)
+	case pd.Column == 0:
+		ret.Range = d.lineSpan(pd.Line - 1)
+	default:
+		start := d.offset(Position{Line: pd.Line - 1})
+		// Columns count runes
+		for i := 1; i < pd.Column && start < len(d.text); i++ {
+			_, size := utf8.DecodeRuneInString(d.text[start:])
+			start += size
+		}
+		end := start
+		if strings.HasPrefix(d.text[start:], pd.Token) {
+			end += len(pd.Token)
+		}
+		ret.Range = d.span(start, end)
+	}
+	return ret
+}
@@ -0,0 +1,214 @@
+package lsp
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/cortesi/moddwatch/filter"
+	"github.com/dottedmag/ppow"
+	"github.com/dottedmag/ppow/conf"
+)
+
+// Variable references
+var reference = regexp.MustCompile(`@\w+`)
+
+// How many of the matching files a hover lists
+const listedFiles = 10
+
+// hover returns what to show for the text at a position, or nil if there's
+// nothing to show
+func (d *document) hover(pos Position) *Hover {
+	off := d.offset(pos)
+	lineStart := strings.LastIndexByte(d.text[:off], '\n') + 1
+	lineEnd := off + strings.IndexByte(d.text[off:]+"\n", '\n')
+	for _, m := range reference.FindAllStringIndex(d.text[lineStart:lineEnd], -1) {
+		start, end := lineStart+m[0], lineStart+m[1]
+		if start <= off && off <= end {
+			return d.hoverVariable(d.text[start:end], start, end)
+		}
+	}
+	return d.hoverPattern(off)
+}
+
+func markdown(span Range, format string, args ...interface{}) *Hover {
+	return &Hover{
+		Contents: markupContent{Kind: "markdown", Value: fmt.Sprintf(format, args...)},
+		Range:    &span,
+	}
+}
+
+// enclosingBlock returns the block a position is in, or nil
+func enclosingBlock(f *conf.File, off int) *conf.BlockStmt {
+	for _, n := range f.Nodes {
+		if p, ok := n.(*conf.ProfileStmt); ok {
+			if int(p.Start()) <= off && off <= int(p.Close.End()) {
+				return enclosingBlock(&conf.File{Nodes: p.Body}, off)
+			}
+			continue
+		}
+		if b, ok := n.(*conf.BlockStmt); ok && int(b.Start()) <= off && off <= int(b.Close.End()) {
+			return b
+		}
+	}
+	return nil
+}
+
+// scope returns the variables visible at a position of a parsed config
+func (d *document) scope(cnf *conf.Config, off int) map[string]string {
+	globals := cnf.GetVariables()
+	f, err := conf.ParseSyntax(d.name(), d.text)
+	if err != nil {
+		return globals
+	}
+	stmt := enclosingBlock(f, off)
+	if stmt == nil {
+		return globals
+	}
+	line := d.position(int(stmt.Start())).Line + 1
+	for _, b := range cnf.Blocks {
+		if b.Source == d.name() && b.Line == line {
+			return b.Scope(globals)
+		}
+	}
+	// The block isn't active, because of its conditions or its profile
+	return globals
+}
+
+func (d *document) hoverVariable(name string, start int, end int) *Hover {
+	span := d.span(start, end)
+	if desc, ok := commandVariables[name]; ok {
+		return markdown(span, "`%s`: %s, set when a command runs", name, desc)
+	}
+	cnf, err := d.parse()
+	if err != nil {
+		// Fall back to the declaration, if we can find one
+		for _, m := range declaration.FindAllStringSubmatch(d.text, -1) {
+			if m[1] == name {
+				return markdown(span, "`%s` is declared as:\n```\n%s\n```", name, strings.TrimSpace(m[2]))
+			}
+		}
+		return nil
+	}
+	val, ok := d.scope(cnf, start)[name]
+	if !ok {
+		return markdown(span, "`%s` isn't declared", name)
+	}
+	note := ""
+	if strings.HasPrefix(val, "$(") && strings.HasSuffix(val, ")") {
+		note = "\n\nThe command runs when ppow starts."
+	}
+	return markdown(span, "`%s` =\n```\n%s\n```%s", name, val, note)
+}
+
+// hoverPattern shows the files a pattern of a block matches
+func (d *document) hoverPattern(off int) *Hover {
+	if d.path == "" {
+		return nil
+	}
+	f, err := conf.ParseSyntax(d.name(), d.text)
+	if err != nil {
+		return nil
+	}
+	stmt := enclosingBlock(f, off)
+	if stmt == nil {
+		return nil
+	}
+	var token *conf.Token
+	for i, t := range stmt.Patterns {
+		if int(t.Pos) <= off && off <= int(t.End()) {
+			token = &stmt.Patterns[i]
+		}
+	}
+	if token == nil || strings.HasPrefix(token.Text, "+") {
+		return nil
+	}
+	globals := map[string]string{}
+	if cnf, err := d.parse(); err == nil {
+		globals = cnf.GetVariables()
+	}
+	var excludes []string
+	noignore := false
+	for _, t := range stmt.Patterns {
+		if t.Text == "+noignore" {
+			noignore = true
+		}
+		if p, ok := pattern(t.Text, globals); ok && strings.HasPrefix(t.Text, "!") {
+			excludes = append(excludes, p)
+		}
+	}
+	if !noignore {
+		excludes = append(excludes, ppow.CommonExcludes...)
+	}
+	pat, _ := pattern(token.Text, globals)
+	span := d.span(int(token.Pos), int(token.End()))
+	files, err := ppow.ListFiles(filepath.Dir(d.path), []string{pat}, nil)
+	if err != nil {
+		return markdown(span, "Can't list the files matching `%s`: %s", pat, err)
+	}
+	if strings.HasPrefix(token.Text, "!") {
+		return markdown(span, "`%s` excludes %s%s", pat, countFiles(len(files)), listFiles(files))
+	}
+	kept, err := filter.Files(files, []string{pat}, excludes)
+	if err != nil {
+		return markdown(span, "Can't filter the files matching `%s`: %s", pat, err)
+	}
+	msg := fmt.Sprintf("`%s` matches %s", pat, countFiles(len(kept)))
+	if n := len(files) - len(kept); n > 0 {
+		msg += fmt.Sprintf(", and %d more that are excluded", n)
+	}
+	return markdown(span, "%s%s", msg, listFiles(kept))
+}
+
+// pattern returns a pattern as the watcher sees it, with quotes and the !
+// of exclusions removed, and variables expanded. It returns false for block
+// options.
+func pattern(text string, globals map[string]string) (string, bool) {
+	if strings.HasPrefix(text, "+") {
+		return "", false
+	}
+	text = strings.TrimPrefix(text, "!")
+	if len(text) >= 2 && strings.ContainsAny(text[:1], `'"`) && text[len(text)-1] == text[0] {
+		text = text[1 : len(text)-1]
+	}
+	ret, err := conf.Expand(text, func(name string) (string, error) {
+		if v, ok := globals[name]; ok {
+			return v, nil
+		}
+		return name, nil
+	})
+	if err != nil {
+		return text, true
+	}
+	if ret != text {
+		for strings.HasPrefix(ret, "./") {
+			ret = ret[2:]
+		}
+	}
+	return ret, true
+}
+
+func countFiles(n int) string {
+	if n == 1 {
+		return "1 file"
+	}
+	return fmt.Sprintf("%d files", n)
+}
+
+// listFiles lists the first few files as markdown
+func listFiles(files []string) string {
+	if len(files) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("\n")
+	for i, f := range files {
+		if i == listedFiles {
+			fmt.Fprintf(&b, "\n- and %d more", len(files)-listedFiles)
+			break
+		}
+		fmt.Fprintf(&b, "\n- `%s`", f)
+	}
+	return b.String()
+}
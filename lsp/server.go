@@ -0,0 +1,227 @@
+// Package lsp implements a Language Server Protocol server for ppow config
+// files. It publishes the problems found by the config parser as the user
+// types, completes directives, options and variables, and shows what patterns
+// match and what variables hold on hover.
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+
+	"github.com/dottedmag/ppow"
+)
+
+// Server is a language server talking to a single client
+type Server struct {
+	in  *bufio.Reader
+	out io.Writer
+	// The text of the open documents, by URI
+	docs        map[string]string
+	initialized bool
+	shutdown    bool
+	// The first error writing to the client, which ends the session
+	err error
+}
+
+// NewServer creates a server that reads messages from in, and writes
+// messages to out
+func NewServer(in io.Reader, out io.Writer) *Server {
+	return &Server{
+		in:   bufio.NewReader(in),
+		out:  out,
+		docs: map[string]string{},
+	}
+}
+
+// Serve handles messages until the client asks the server to exit. It returns
+// an error if the connection fails, or if the client leaves without shutting
+// the server down first.
+func (s *Server) Serve() error {
+	for {
+		body, err := s.read()
+		if err == io.EOF {
+			if !s.shutdown {
+				return errors.New("connection closed before shutdown")
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var req request
+		if err := json.Unmarshal(body, &req); err != nil {
+			s.reply(nil, nil, &responseError{codeParseError, err.Error()})
+		} else if req.Method == "exit" {
+			if !s.shutdown {
+				return errors.New("exit before shutdown")
+			}
+			return nil
+		} else {
+			result, rerr := s.handle(req)
+			// Notifications get no reply, even when they fail
+			if req.ID != nil {
+				s.reply(req.ID, result, rerr)
+			}
+		}
+		if s.err != nil {
+			return s.err
+		}
+	}
+}
+
+// read reads the body of the next message
+func (s *Server) read() ([]byte, error) {
+	header, err := textproto.NewReader(s.in).ReadMIMEHeader()
+	if err != nil {
+		if err == io.EOF || (errors.Is(err, io.ErrUnexpectedEOF) && len(header) == 0) {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	length, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid Content-Length: %q", header.Get("Content-Length"))
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(s.in, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+func (s *Server) write(msg interface{}) {
+	if s.err != nil {
+		return
+	}
+	body, err := json.Marshal(msg)
+	if err == nil {
+		_, err = fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	}
+	s.err = err
+}
+
+func (s *Server) reply(id json.RawMessage, result interface{}, rerr *responseError) {
+	if id == nil {
+		id = null
+	}
+	resp := response{JSONRPC: "2.0", ID: id, Error: rerr}
+	if rerr == nil {
+		resp.Result = result
+		if result == nil {
+			resp.Result = null
+		}
+	}
+	s.write(resp)
+}
+
+func (s *Server) notify(method string, params interface{}) {
+	s.write(notification{JSONRPC: "2.0", Method: method, Params: params})
+}
+
+// handle handles a request or a notification, and returns the result
+func (s *Server) handle(req request) (interface{}, *responseError) {
+	if !s.initialized && req.Method != "initialize" {
+		return nil, &responseError{codeServerNotInitialized, "the server isn't initialized"}
+	}
+	if s.shutdown {
+		return nil, &responseError{codeInvalidRequest, "the server is shutting down"}
+	}
+	switch req.Method {
+	case "initialize":
+		s.initialized = true
+		var ret initializeResult
+		ret.Capabilities.TextDocumentSync = syncFull
+		ret.Capabilities.CompletionProvider.TriggerCharacters = []string{"@", "+"}
+		ret.Capabilities.HoverProvider = true
+		ret.ServerInfo.Name = "ppow"
+		ret.ServerInfo.Version = ppow.Version
+		return ret, nil
+	case "initialized":
+		return nil, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+	case "textDocument/didOpen":
+		var params didOpenParams
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, invalidParams(err)
+		}
+		s.update(params.TextDocument.URI, params.TextDocument.Text)
+		return nil, nil
+	case "textDocument/didChange":
+		var params didChangeParams
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, invalidParams(err)
+		}
+		if len(params.ContentChanges) == 0 {
+			return nil, nil
+		}
+		// We ask for whole documents, so the last change holds the text
+		text := params.ContentChanges[len(params.ContentChanges)-1].Text
+		s.update(params.TextDocument.URI, text)
+		return nil, nil
+	case "textDocument/didClose":
+		var params didCloseParams
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, invalidParams(err)
+		}
+		delete(s.docs, params.TextDocument.URI)
+		// Problems in closed documents aren't shown
+		s.notify("textDocument/publishDiagnostics", publishDiagnosticsParams{
+			URI:         params.TextDocument.URI,
+			Diagnostics: []Diagnostic{},
+		})
+		return nil, nil
+	case "textDocument/completion":
+		doc, pos, rerr := s.position(req.Params)
+		if rerr != nil {
+			return nil, rerr
+		}
+		return doc.complete(pos), nil
+	case "textDocument/hover":
+		doc, pos, rerr := s.position(req.Params)
+		if rerr != nil {
+			return nil, rerr
+		}
+		if h := doc.hover(pos); h != nil {
+			return h, nil
+		}
+		return nil, nil
+	}
+	return nil, &responseError{codeMethodNotFound, fmt.Sprintf("unknown method: %s", req.Method)}
+}
+
+// update stores the new text of a document, and publishes its problems
+func (s *Server) update(uri string, text string) {
+	s.docs[uri] = text
+	s.notify("textDocument/publishDiagnostics", publishDiagnosticsParams{
+		URI:         uri,
+		Diagnostics: newDocument(uri, text).diagnostics(),
+	})
+}
+
+// position decodes the parameters of a request about a position in a
+// document
+func (s *Server) position(raw json.RawMessage) (*document, Position, *responseError) {
+	var params positionParams
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, Position{}, invalidParams(err)
+	}
+	text, ok := s.docs[params.TextDocument.URI]
+	if !ok {
+		return nil, Position{}, &responseError{
+			codeInvalidParams,
+			fmt.Sprintf("document isn't open: %s", params.TextDocument.URI),
+		}
+	}
+	return newDocument(params.TextDocument.URI, text), params.Position, nil
+}
+
+func invalidParams(err error) *responseError {
+	return &responseError{codeInvalidParams, err.Error()}
+}
@@ -0,0 +1,273 @@
+package lsp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// session sends messages to a server, and returns what it sends back
+func session(t *testing.T, msgs ...string) []map[string]interface{} {
+	var in, out bytes.Buffer
+	for _, m := range msgs {
+		fmt.Fprintf(&in, "Content-Length: %d\r\n\r\n%s", len(m), m)
+	}
+	if err := NewServer(&in, &out).Serve(); err != nil {
+		t.Fatal(err)
+	}
+	var ret []map[string]interface{}
+	r := bufio.NewReader(&out)
+	for {
+		header, err := textproto.NewReader(r).ReadMIMEHeader()
+		if err != nil {
+			return ret
+		}
+		n, err := strconv.Atoi(header.Get("Content-Length"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := make([]byte, n)
+		if _, err := io.ReadFull(r, body); err != nil {
+			t.Fatal(err)
+		}
+		var msg map[string]interface{}
+		if err := json.Unmarshal(body, &msg); err != nil {
+			t.Fatal(err)
+		}
+		ret = append(ret, msg)
+	}
+}
+
+func TestSession(t *testing.T) {
+	uri := "file:///project/ppow.conf"
+	ret := session(t,
+		`{"jsonrpc": "2.0", "id": 1, "method": "initialize", "params": {}}`,
+		`{"jsonrpc": "2.0", "method": "initialized", "params": {}}`,
+		`{"jsonrpc": "2.0", "method": "textDocument/didOpen", "params": {"textDocument": {"uri": "`+uri+`", "text": "{\ndeamon: a\n}"}}}`,
+		`{"jsonrpc": "2.0", "method": "textDocument/didChange", "params": {"textDocument": {"uri": "`+uri+`"}, "contentChanges": [{"text": "{\ndaemon: a\n}"}]}}`,
+		`{"jsonrpc": "2.0", "id": 2, "method": "textDocument/hover", "params": {"textDocument": {"uri": "file:///other.conf"}, "position": {"line": 0, "character": 0}}}`,
+		`{"jsonrpc": "2.0", "id": 3, "method": "no/such/method"}`,
+		`{"jsonrpc": "2.0", "id": 4, "method": "shutdown"}`,
+		`{"jsonrpc": "2.0", "method": "exit"}`,
+	)
+	if len(ret) != 6 {
+		t.Fatalf("Expected 6 messages, got %d: %v", len(ret), ret)
+	}
+	caps := ret[0]["result"].(map[string]interface{})["capabilities"].(map[string]interface{})
+	if caps["hoverProvider"] != true || caps["textDocumentSync"] != 1.0 {
+		t.Errorf("Unexpected capabilities: %v", caps)
+	}
+	expected := []map[string]interface{}{
+		{
+			"jsonrpc": "2.0",
+			"method":  "textDocument/publishDiagnostics",
+			"params": map[string]interface{}{
+				"uri": uri,
+				"diagnostics": []interface{}{
+					map[string]interface{}{
+						"range": map[string]interface{}{
+							"start": map[string]interface{}{"line": 1.0, "character": 0.0},
+							"end":   map[string]interface{}{"line": 1.0, "character": 6.0},
+						},
+						"severity": 1.0,
+						"source":   "ppow",
+						"message":  "unknown directive: deamon (did you mean daemon?)",
+					},
+				},
+			},
+		},
+		{
+			"jsonrpc": "2.0",
+			"method":  "textDocument/publishDiagnostics",
+			"params":  map[string]interface{}{"uri": uri, "diagnostics": []interface{}{}},
+		},
+		{
+			"jsonrpc": "2.0",
+			"id":      2.0,
+			"error":   map[string]interface{}{"code": -32602.0, "message": "document isn't open: file:///other.conf"},
+		},
+		{
+			"jsonrpc": "2.0",
+			"id":      3.0,
+			"error":   map[string]interface{}{"code": -32601.0, "message": "unknown method: no/such/method"},
+		},
+		{"jsonrpc": "2.0", "id": 4.0, "result": nil},
+	}
+	if diff := cmp.Diff(expected, ret[1:]); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestExitWithoutShutdown(t *testing.T) {
+	in := strings.NewReader("Content-Length: 31\r\n\r\n{\"jsonrpc\":\"2.0\",\"method\":\"exit\"}")
+	if err := NewServer(in, &bytes.Buffer{}).Serve(); err == nil {
+		t.Error("Expected an error")
+	}
+}
+
+var positionTests = []struct {
+	text     string
+	pos      Position
+	expected int
+}{
+	{"abc\ndef", Position{0, 0}, 0},
+	{"abc\ndef", Position{1, 2}, 6},
+	{"abc\ndef", Position{0, 10}, 3},
+	{"abc\ndef", Position{5, 0}, 7},
+	// é takes one UTF-16 unit and two bytes, 😀 two units and four bytes
+	{"é😀x\ny", Position{0, 1}, 2},
+	{"é😀x\ny", Position{0, 3}, 6},
+	{"é😀x\ny", Position{1, 1}, 9},
+}
+
+func TestPositions(t *testing.T) {
+	for _, tt := range positionTests {
+		d := newDocument("file:///ppow.conf", tt.text)
+		if ret := d.offset(tt.pos); ret != tt.expected {
+			t.Errorf("%q %v: expected offset %d, got %d", tt.text, tt.pos, tt.expected, ret)
+			continue
+		}
+		if tt.pos.Line < 2 && tt.pos.Character < 4 {
+			if ret := d.position(tt.expected); ret != tt.pos {
+				t.Errorf("%q %d: expected %v, got %v", tt.text, tt.expected, tt.pos, ret)
+			}
+		}
+	}
+}
+
+var diagnosticTests = []struct {
+	text     string
+	expected []Diagnostic
+}{
+	{"{\n    prep: a\n}\n", []Diagnostic{}},
+	{
+		"# é\n{\n    daemon +sigtem: a\n}",
+		[]Diagnostic{{
+			Range:    Range{Position{2, 11}, Position{2, 18}},
+			Severity: severityError,
+			Source:   "ppow",
+			Message:  "unknown signal: sigtem (did you mean sigterm?)",
+		}},
+	},
+	{
+		"é {\n",
+		[]Diagnostic{{
+			Range:    Range{Position{1, 0}, Position{1, 0}},
+			Severity: severityError,
+			Source:   "ppow",
+			Message:  "unterminated block (the block opened on line 1 needs a closing })",
+		}},
+	},
+}
+
+func TestDiagnostics(t *testing.T) {
+	for _, tt := range diagnosticTests {
+		ret := newDocument("file:///project/ppow.conf", tt.text).diagnostics()
+		if diff := cmp.Diff(tt.expected, ret); diff != "" {
+			t.Errorf("%q\n%s", tt.text, diff)
+		}
+	}
+}
+
+// The position is marked with a |
+var completeTests = []struct {
+	text     string
+	expected []string
+}{
+	{"foo {\n    |\n}", []string{"daemon", "indir", "name", "prep"}},
+	{"foo {\n    da|\n}", []string{"daemon", "indir", "name", "prep"}},
+	{"foo {\n    prep +|\n}", []string{"+allowfail", "+always", "+onchange", "+parallel", "+retry=", "+timeout="}},
+	{"foo {\n    prep: go test |\n}", []string{}},
+	{"foo |", []string{}},
+	{"foo +|", []string{"+arch=", "+concurrent", "+disable", "+if=", "+noignore", "+os=", "+restart-on-change", "+strict"}},
+	{"profile ci +|", []string{"+default"}},
+	{"@a +|", []string{"+ontrigger"}},
+	{"@a = b\n@c ?= d\n|", []string{}},
+	{"@a = b\nfoo/@|", []string{"@a", "@confdir"}},
+	{
+		"@a = b\nfoo {\n    @c = d\n    prep: echo \"@|\"\n}",
+		[]string{"@a", "@c", "@confdir", "@dirmods", "@mods"},
+	},
+}
+
+func TestComplete(t *testing.T) {
+	for _, tt := range completeTests {
+		pos := strings.Index(tt.text, "|")
+		d := newDocument("file:///project/ppow.conf", tt.text[:pos]+tt.text[pos+1:])
+		ret := []string{}
+		for _, itm := range d.complete(d.position(pos)) {
+			ret = append(ret, itm.Label)
+		}
+		if diff := cmp.Diff(tt.expected, ret); diff != "" {
+			t.Errorf("%q\n%s", tt.text, diff)
+		}
+	}
+}
+
+func TestCompleteDaemonOptions(t *testing.T) {
+	text := "{\n    daemon +sig"
+	d := newDocument("file:///project/ppow.conf", text)
+	ret := d.complete(d.position(len(text)))
+	if len(ret) == 0 || !strings.HasPrefix(ret[0].Label, "+sig") {
+		t.Fatalf("Expected signal options, got %v", ret)
+	}
+	expected := Range{Position{1, 11}, Position{1, 15}}
+	if ret[0].TextEdit.Range != expected {
+		t.Errorf("Expected the edit to replace %v, got %v", expected, ret[0].TextEdit.Range)
+	}
+}
+
+func TestHover(t *testing.T) {
+	dir := t.TempDir()
+	for _, f := range []string{"src/a.go", "src/b.go", "src/b_test.go", "src/.git/x.go"} {
+		path := filepath.Join(dir, filepath.FromSlash(f))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	text := "@src = src\n" +
+		"@date = $(date)\n" +
+		"@src/**/*.go !**/*_test.go {\n" +
+		"    @bin = @src/bin\n" +
+		"    prep: go build -o @bin @mods\n" +
+		"}\n" +
+		"docs/** {}\n"
+	d := newDocument("file://"+filepath.ToSlash(filepath.Join(dir, "ppow.conf")), text)
+
+	tests := []struct {
+		pos      Position
+		expected string
+	}{
+		{Position{2, 6}, "`src/**/*.go` matches 2 files, and 2 more that are excluded\n\n- `src/a.go`\n- `src/b.go`"},
+		{Position{2, 14}, "`**/*_test.go` excludes 1 file\n\n- `src/b_test.go`"},
+		{Position{6, 2}, "`docs/**` matches 0 files"},
+		{Position{0, 2}, "`@src` =\n```\nsrc\n```"},
+		{Position{4, 22}, "`@bin` =\n```\nsrc/bin\n```"},
+		{Position{4, 27}, "`@mods`: the files that changed, set when a command runs"},
+		{Position{1, 1}, "`@date` =\n```\n$(date)\n```\n\nThe command runs when ppow starts."},
+		{Position{2, 29}, ""},
+		{Position{4, 6}, ""},
+	}
+	for _, tt := range tests {
+		ret := ""
+		if h := d.hover(tt.pos); h != nil {
+			ret = h.Contents.Value
+		}
+		if ret != tt.expected {
+			t.Errorf("%v: expected\n%q\ngot\n%q", tt.pos, tt.expected, ret)
+		}
+	}
+}
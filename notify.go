@@ -35,7 +35,7 @@ type GrowlNotifier struct {
 // Push implements Notifier
 func (GrowlNotifier) Push(title string, text string, iconPath string) {
 	cmd := exec.Command(
-		"growlnotify", "-n", prog, "-d", prog, "-m", text, prog,
+		"growlnotify", "-n", prog, "-d", prog, "-m", text, title,
 	)
 	go cmd.Run()
 }
@@ -47,7 +47,7 @@ type LibnotifyNotifier struct {
 // Push implements Notifier
 func (LibnotifyNotifier) Push(title string, text string, iconPath string) {
 	cmd := exec.Command(
-		"notify-send", prog, text,
+		"notify-send", title, text,
 	)
 	go cmd.Run()
 }
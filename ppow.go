@@ -4,7 +4,12 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"path"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -20,6 +25,10 @@ const lullTime = time.Millisecond * 100
 
 const shellVarName = "@shell"
 
+// LocalConfName is the name of the personal override file that is read from
+// the directory of the main config file
+const LocalConfName = "ppow.local.conf"
+
 // CommonExcludes is a list of commonly excluded files suitable for passing in
 // the excludes parameter to Watch - includes repo directories, temporary
 // files, and so forth.
@@ -50,6 +59,45 @@ var CommonExcludes = []string{
 	"**/node_modules/**",
 }
 
+// Options controls how a ModRunner loads its config
+type Options struct {
+	// Only restricts the runner to the blocks with these names
+	Only []string
+	// Skip excludes the blocks with these names
+	Skip []string
+	// Vars overrides the values of config variables. Names don't include the
+	// leading @.
+	Vars map[string]string
+	// Profile selects a config profile. If it is empty, the default profile
+	// is used.
+	Profile string
+	// Root is the directory that patterns, indir and the paths in @mods are
+	// relative to, and that commands run in by default. If it is empty, the
+	// current directory is used.
+	Root string
+	// Recursive runs the configs named ConfName found in subdirectories too,
+	// each with its own directory as root
+	Recursive bool
+	// Extra lists more configs to run alongside the main one, after it
+	Extra []ExtraConfig
+	// NoEval loads configs without running the commands of computed
+	// variables, which keep their unevaluated values
+	NoEval bool
+	// Jobs is how many blocks may run at once. Only blocks flagged with
+	// +concurrent run alongside others; the rest run one after the other.
+	Jobs int
+}
+
+// ExtraConfig is a config that runs alongside the main one. It is parsed on
+// its own, so it has its own variables and @confdir, but its blocks share the
+// watcher and daemons of the main config.
+type ExtraConfig struct {
+	Path string
+	// Root is the directory the config's paths are relative to, as with
+	// Options.Root
+	Root string
+}
+
 // ModRunner coordinates running the ppow command
 type ModRunner struct {
 	Log        termlog.TermLog
@@ -57,16 +105,26 @@ type ModRunner struct {
 	ConfPath   string
 	ConfReload bool
 	Notifiers  []Notifier
+	Options    Options
 	signalled  bool
+
+	// The changes that blocks stopped by +restart-on-change were running for,
+	// by block index. They're run again with the next changes. A nil Mod is
+	// the initial run.
+	interrupted map[int]*moddwatch.Mod
+
+	// All the configs being run, starting with Config
+	files []*configFile
 }
 
 // NewModRunner constructs a new ModRunner
-func NewModRunner(confPath string, log termlog.TermLog, notifiers []Notifier, confreload bool) (*ModRunner, error) {
+func NewModRunner(confPath string, log termlog.TermLog, notifiers []Notifier, confreload bool, opts Options) (*ModRunner, error) {
 	mr := &ModRunner{
 		Log:        log,
 		ConfPath:   confPath,
 		ConfReload: confreload,
 		Notifiers:  notifiers,
+		Options:    opts,
 	}
 	err := mr.ReadConfig()
 	if err != nil {
@@ -75,91 +133,496 @@ func NewModRunner(confPath string, log termlog.TermLog, notifiers []Notifier, co
 	return mr, nil
 }
 
-// ReadConfig parses the configuration file in ConfPath
+// ReadConfig parses the configuration file in ConfPath, and with
+// Options.Recursive, the configs in subdirectories. Files with a .json
+// extension hold a config in the form written by DumpConfig.
 func (mr *ModRunner) ReadConfig() error {
-	ret, err := os.ReadFile(mr.ConfPath)
+	var files []*configFile
+	if mr.ConfPath != "" || !mr.Options.Recursive {
+		cnf, err := mr.readConfigFile(mr.ConfPath, mr.Options.Root)
+		if err != nil {
+			return err
+		}
+		files = append(files, &configFile{path: mr.ConfPath, root: mr.Options.Root, config: cnf})
+	}
+	for _, e := range mr.Options.Extra {
+		if seen(files, e.Path) {
+			continue
+		}
+		cnf, err := mr.readConfigFile(e.Path, e.Root)
+		if err != nil {
+			return err
+		}
+		files = append(files, &configFile{path: e.Path, root: e.Root, config: cnf})
+	}
+	if mr.Options.Recursive {
+		paths, err := findConfigs()
+		if err != nil {
+			return fmt.Errorf("Error finding config files: %s", err)
+		}
+		for _, p := range paths {
+			if seen(files, p) {
+				continue
+			}
+			root := filepath.Dir(p)
+			if root == "." {
+				root = ""
+			}
+			cnf, err := mr.readConfigFile(p, root)
+			if err != nil {
+				return err
+			}
+			files = append(files, &configFile{path: p, root: root, config: cnf})
+		}
+		if len(files) == 0 {
+			return fmt.Errorf("No %s files found", ConfName)
+		}
+	}
+	if err := mr.selectBlocks(files); err != nil {
+		return err
+	}
+	for _, f := range files {
+		f.log = mr.Log
+		// With several configs, commands are told apart by the directory of
+		// their config, or by its name if it's in the current directory
+		if len(files) > 1 {
+			if f.root != "" {
+				f.log = &prefixLog{mr.Log, "[" + filepath.ToSlash(f.root) + "] "}
+			} else if filepath.Base(f.path) != ConfName {
+				f.log = &prefixLog{mr.Log, "[" + filepath.ToSlash(f.path) + "] "}
+			}
+		}
+	}
+	mr.files = files
+	mr.Config = files[0].config
+	return nil
+}
+
+// selectBlocks applies Options.Only, Options.Skip and Options.Profile to the
+// configs together: a block or profile only has to be declared by one of them.
+// Configs that don't declare the profile have used their default one.
+func (mr *ModRunner) selectBlocks(files []*configFile) error {
+	if name := mr.Options.Profile; name != "" {
+		var profiles []string
+		for _, f := range files {
+			for _, p := range f.config.Profiles {
+				if !slices.Contains(profiles, p) {
+					profiles = append(profiles, p)
+				}
+			}
+		}
+		if len(profiles) == 0 {
+			return fmt.Errorf("unknown profile %q: no profiles are declared", name)
+		} else if !slices.Contains(profiles, name) {
+			return fmt.Errorf("unknown profile %q, expected one of: %s", name, strings.Join(profiles, ", "))
+		}
+	}
+	for _, n := range append(append([]string{}, mr.Options.Only...), mr.Options.Skip...) {
+		if !slices.ContainsFunc(files, func(f *configFile) bool { return f.config.HasBlock(n) }) {
+			return fmt.Errorf("no block named %q", n)
+		}
+	}
+	for _, f := range files {
+		f.config.FilterBlocks(mr.Options.Only, mr.Options.Skip)
+	}
+	return nil
+}
+
+// readConfigFile parses one config, with its paths relative to root
+func (mr *ModRunner) readConfigFile(confPath string, root string) (*conf.Config, error) {
+	ret, err := os.ReadFile(confPath)
 	if err != nil {
-		return fmt.Errorf("Error reading config file %s: %s", mr.ConfPath, err)
+		return nil, fmt.Errorf("Error reading config file %s: %s", confPath, err)
+	}
+	vars := map[string]string{}
+	for k, v := range mr.Options.Vars {
+		vars["@"+k] = v
+	}
+	opts := conf.Options{
+		Local:     localConfPath(confPath),
+		Variables: vars,
+		Profile:   mr.Options.Profile,
+		Root:      root,
+		// The profile is checked against all configs by selectBlocks
+		ProfileFallback: true,
+	}
+	if !mr.Options.NoEval {
+		opts.Eval = evalCommand
+	}
+	var newcnf *conf.Config
+	if filepath.Ext(confPath) == ".json" {
+		newcnf, err = conf.ParseJSON(confPath, ret, opts)
+	} else {
+		newcnf, err = conf.ParseWithOptions(confPath, string(ret), opts)
 	}
-	newcnf, err := conf.Parse(mr.ConfPath, string(ret))
 	if err != nil {
-		return fmt.Errorf("Error reading config file %s: %s", mr.ConfPath, err)
+		return nil, fmt.Errorf("Error reading config file %s: %w", confPath, err)
 	}
+	mr.logSources(newcnf)
 
 	if _, err := GetShellName(newcnf.GetVariables()[shellVarName]); err != nil {
-		return err
+		return nil, err
+	}
+	if _, err := prepTimeout(newcnf.GetVariables()); err != nil {
+		return nil, err
 	}
 
 	newcnf.CommonExcludes(CommonExcludes)
-	mr.Config = newcnf
-	return nil
+	return newcnf, nil
 }
 
-// PrepOnly runs all prep functions and exits
-func (mr *ModRunner) PrepOnly(initial bool) error {
-	for _, b := range mr.Config.Blocks {
-		err := RunPreps(b, mr.Config.GetVariables(), nil, mr.Log, mr.Notifiers, initial)
-		if err != nil {
-			return err
+// configs returns the configs being run. A ModRunner that was set up without
+// ReadConfig runs just its Config.
+func (mr *ModRunner) configs() []*configFile {
+	if mr.files != nil {
+		return mr.files
+	}
+	return []*configFile{{path: mr.ConfPath, root: mr.Options.Root, log: mr.Log, config: mr.Config}}
+}
+
+// DumpConfig returns the JSON form of a config, with daemon commands rendered
+// as they will be run
+func DumpConfig(cnf *conf.Config) (*conf.JSONConfig, error) {
+	ret := cnf.JSON()
+	globals := cnf.GetVariables()
+	for i, b := range cnf.Blocks {
+		vcmd := VarCmd{Vars: b.Scope(globals)}
+		for j, d := range b.Daemons {
+			cmd, err := vcmd.Render(d.Command)
+			if err != nil {
+				return nil, blockError(&b, err)
+			}
+			ret.Blocks[i].Daemons[j].Rendered = cmd
 		}
 	}
-	return nil
+	return ret, nil
 }
 
-func (mr *ModRunner) runBlock(b conf.Block, mod *moddwatch.Mod, dpen *DaemonPen) {
-	if b.InDir != "" {
-		currentDir, err := os.Getwd()
-		if err != nil {
-			mr.Log.Shout("Error getting current working directory: %s", err)
-			return
+// evalCommand runs the command of a computed variable in dir, and returns its
+// output with trailing newlines removed
+func evalCommand(shell string, dir string, command string) (string, error) {
+	sh, err := GetShellName(shell)
+	if err != nil {
+		return "", err
+	}
+	ex, err := NewExecutor(sh, command, dir)
+	if err != nil {
+		return "", err
+	}
+	out, state, err := ex.Output()
+	if err != nil {
+		return "", err
+	}
+	if state.Error != nil {
+		stderr := strings.TrimSpace(state.ErrOutput)
+		if stderr == "" {
+			return "", fmt.Errorf("%s: %s", command, state.Error)
 		}
-		err = os.Chdir(b.InDir)
-		if err != nil {
-			mr.Log.Shout(
-				"Error changing to indir directory \"%s\": %s",
-				b.InDir,
-				err,
-			)
-			return
+		return "", fmt.Errorf("%s: %s\n%s", command, state.Error, stderr)
+	}
+	return strings.TrimRight(out, "\r\n"), nil
+}
+
+// localConfPath returns the path of the local override file for a config
+func localConfPath(confPath string) string {
+	return filepath.Join(filepath.Dir(confPath), LocalConfName)
+}
+
+// logSources logs the file each block and variable was declared in
+func (mr *ModRunner) logSources(cnf *conf.Config) {
+	if cnf.Profile != "" {
+		mr.Log.SayAs("debug", "profile %s", cnf.Profile)
+	}
+	vars := cnf.GetVariables()
+	names := make([]string, 0, len(vars))
+	for k := range vars {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		mr.Log.SayAs("debug", "%s = %q (from %s)", k, vars[k], cnf.VariableSource(k))
+	}
+	for _, b := range cnf.Blocks {
+		if b.Name != "" {
+			mr.Log.SayAs("debug", "block %s %v (from %s)", b.Name, b.Include, b.Source)
+		} else {
+			mr.Log.SayAs("debug", "block %v (from %s)", b.Include, b.Source)
 		}
-		defer func() {
-			err := os.Chdir(currentDir)
+	}
+}
+
+// confFiles returns the paths of all files the current configs were read
+// from, in the normalised form used by the watcher: slash-delimited, and
+// relative to the watch root if they lie underneath it.
+func (mr *ModRunner) confFiles() []string {
+	var files []string
+	for _, cf := range mr.configs() {
+		files = append(files, cf.path, localConfPath(cf.path))
+		if cf.config != nil {
+			files = append(files, cf.config.Includes...)
+		}
+	}
+	root, err := mr.watchRoot()
+	for i, f := range files {
+		abs, aerr := filepath.Abs(f)
+		if err != nil || aerr != nil {
+			files[i] = filepath.ToSlash(f)
+			continue
+		}
+		files[i] = rebase(filepath.ToSlash(abs), root, root)
+	}
+	return files
+}
+
+// watchRoot returns the absolute directory the watcher reports changes
+// relative to: the root of the configs if they share one, and the current
+// directory otherwise
+func (mr *ModRunner) watchRoot() (string, error) {
+	files := mr.configs()
+	root := files[0].root
+	for _, cf := range files[1:] {
+		if cf.root != root {
+			root = ""
+		}
+	}
+	if root == "" || mr.Options.Recursive {
+		return os.Getwd()
+	}
+	return filepath.Abs(root)
+}
+
+// watchPatterns returns the include patterns of all blocks, relative to the
+// watch root
+func (mr *ModRunner) watchPatterns(root string) ([]string, error) {
+	pmap := map[string]bool{}
+	for _, cf := range mr.configs() {
+		for i := range cf.config.Blocks {
+			b := &cf.config.Blocks[i]
+			broot, err := blockRoot(b)
 			if err != nil {
-				mr.Log.Shout("Error returning to original directory: %s", err)
+				return nil, err
 			}
-		}()
+			for _, p := range rebaseAll(b.Include, broot, root) {
+				pmap[p] = true
+			}
+		}
+	}
+	ret := make([]string, 0, len(pmap))
+	for p := range pmap {
+		ret = append(ret, p)
 	}
-	err := RunPreps(
-		b,
-		mr.Config.GetVariables(),
-		mod, mr.Log,
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// confChanged checks whether a Mod touches any of the config files, or with
+// Options.Recursive, adds or removes one
+func (mr *ModRunner) confChanged(mod *moddwatch.Mod) bool {
+	for _, f := range mr.confFiles() {
+		if mod.Has(f) {
+			return true
+		}
+	}
+	if mr.Options.Recursive {
+		for _, p := range append(mod.Added, mod.Deleted...) {
+			if path.Base(p) == ConfName {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// PrepOnly runs all prep functions and exits
+func (mr *ModRunner) PrepOnly(initial bool) error {
+	for _, cf := range mr.configs() {
+		for _, b := range cf.config.Blocks {
+			vars, err := cf.config.TriggerVariables(evalCommand)
+			if err != nil {
+				return err
+			}
+			err = RunPreps(b, vars, nil, cf.log, mr.Notifiers, initial, nil)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (mr *ModRunner) runBlock(r *blockRun) {
+	vars, err := r.cf.config.TriggerVariables(evalCommand)
+	if err != nil {
+		mr.Log.Shout("Error evaluating variables: %s", err)
+		return
+	}
+	err = RunPreps(
+		r.b,
+		vars,
+		r.mod, r.cf.log,
 		mr.Notifiers,
-		mod == nil,
+		r.mod == nil,
+		r.stop,
 	)
 	if err != nil {
-		if _, ok := err.(ProcError); !ok {
+		if pe, ok := err.(ProcError); !ok {
 			mr.Log.Shout("Error running prep: %s", err)
+		} else if pe.Kind == ProcStopped {
+			r.stopped = true
 		}
 		return
 	}
-	dpen.Restart()
+	r.dpen.Restart()
 }
 
-func (mr *ModRunner) trigger(root string, mod *moddwatch.Mod, dworld *DaemonWorld) {
-	for i, b := range mr.Config.Blocks {
-		lmod := mod
-		if lmod != nil {
-			var err error
-			lmod, err = mod.Filter(root, b.Include, b.Exclude)
-			if err != nil {
-				mr.Log.Shout("Error filtering events: %s", err)
+// blockRun is a block to run, with the changes that triggered it
+type blockRun struct {
+	cf   *configFile
+	b    conf.Block
+	mod  *moddwatch.Mod
+	dpen *DaemonPen
+	// index is the index of the block among the blocks of all configs
+	index int
+	// stop is closed to stop the block's prep commands, and stopped is set
+	// if they were
+	stop    chan struct{}
+	stopped bool
+}
+
+// runBlocks runs blocks and waits for them to finish. With more than one job,
+// each block flagged with +concurrent is run on its own, and the other blocks
+// are run in order as one job. Up to Options.Jobs of these run at once.
+func (mr *ModRunner) runBlocks(runs []*blockRun) {
+	if mr.Options.Jobs <= 1 {
+		for _, r := range runs {
+			mr.runBlock(r)
+		}
+		return
+	}
+	var serial []*blockRun
+	var jobs []func()
+	for _, r := range runs {
+		if r.b.Concurrent {
+			jobs = append(jobs, func() { mr.runBlock(r) })
+		} else {
+			serial = append(serial, r)
+		}
+	}
+	if serial != nil {
+		jobs = append([]func(){func() {
+			for _, r := range serial {
+				mr.runBlock(r)
+			}
+		}}, jobs...)
+	}
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, mr.Options.Jobs)
+	for _, job := range jobs {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			job()
+			<-slots
+		}()
+	}
+	wg.Wait()
+}
+
+// blockMod returns the changes that match a block, relative to the block's
+// root
+func blockMod(root string, mod *moddwatch.Mod, b *conf.Block) (*moddwatch.Mod, error) {
+	broot, err := blockRoot(b)
+	if err != nil {
+		return nil, fmt.Errorf("Error finding the block root: %s", err)
+	}
+	lmod, err := mod.Filter(
+		root,
+		rebaseAll(b.Include, broot, root),
+		rebaseAll(b.Exclude, broot, root),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("Error filtering events: %s", err)
+	}
+	// @mods is relative to the block's root
+	return rebaseMod(lmod, root, broot), nil
+}
+
+// trigger runs the blocks that match a batch of changes, or all blocks if mod
+// is nil. While they run, it reads further changes from modchan, and stops the
+// blocks flagged with +restart-on-change that match them. It returns the
+// changes it read, to be handled next.
+func (mr *ModRunner) trigger(root string, mod *moddwatch.Mod, dworld *DaemonWorld, modchan chan *moddwatch.Mod) []*moddwatch.Mod {
+	var runs []*blockRun
+	i := 0
+	for _, cf := range mr.configs() {
+		for _, b := range cf.config.Blocks {
+			r := &blockRun{cf: cf, b: b, mod: mod, dpen: dworld.DaemonPens[i], index: i}
+			i++
+			if mod != nil {
+				lmod, err := blockMod(root, mod, &b)
+				if err != nil {
+					mr.Log.Shout("%s", err)
+					continue
+				}
+				r.mod = lmod
+			}
+			if prev, ok := mr.interrupted[r.index]; ok {
+				// The block was stopped before it finished, so it runs
+				// again for the changes it was running for as well
+				delete(mr.interrupted, r.index)
+				if prev == nil || r.mod == nil {
+					r.mod = nil
+				} else {
+					joined := prev.Join(*r.mod)
+					r.mod = &joined
+				}
+			} else if r.mod != nil && r.mod.Empty() {
 				continue
 			}
-			if lmod.Empty() {
+			if b.RestartOnChange {
+				r.stop = make(chan struct{})
+			}
+			runs = append(runs, r)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		mr.runBlocks(runs)
+		close(done)
+	}()
+	var queued []*moddwatch.Mod
+	for {
+		select {
+		case <-done:
+			for _, r := range runs {
+				if r.stopped {
+					if mr.interrupted == nil {
+						mr.interrupted = map[int]*moddwatch.Mod{}
+					}
+					mr.interrupted[r.index] = r.mod
+				}
+			}
+			return queued
+		case next, ok := <-modchan:
+			if !ok {
+				next = nil
+				modchan = nil
+			}
+			queued = append(queued, next)
+			if next == nil || next == sentinel {
 				continue
 			}
+			for _, r := range runs {
+				if r.stop == nil || isClosed(r.stop) {
+					continue
+				}
+				if lmod, err := blockMod(root, next, &r.b); err == nil && !lmod.Empty() {
+					close(r.stop)
+				}
+			}
 		}
-		mr.runBlock(b, lmod, dworld.DaemonPens[i])
 	}
 }
 
@@ -208,11 +671,112 @@ func nonFatalSignal(sig os.Signal) bool {
 	return false
 }
 
+// watch starts watching the files of all configs, and passes the changes on to
+// modchan. The watcher can be stopped and replaced without closing modchan.
+func (mr *ModRunner) watch(root string, modchan chan *moddwatch.Mod) (*moddwatch.Watcher, error) {
+	ipatts, err := mr.watchPatterns(root)
+	if err != nil {
+		return nil, err
+	}
+	if mr.ConfReload {
+		ipatts = append(ipatts, mr.confFiles()...)
+		if mr.Options.Recursive {
+			ipatts = append(ipatts, "**/"+ConfName)
+		}
+	}
+	ch := make(chan *moddwatch.Mod, 1024)
+	watcher, err := moddwatch.Watch(root, ipatts, []string{}, lullTime, ch)
+	if err != nil {
+		return nil, fmt.Errorf("Error watching: %s", err)
+	}
+	go func() {
+		for mod := range ch {
+			modchan <- mod
+		}
+	}()
+	return watcher, nil
+}
+
+// changedConfigs returns the indexes of the configs whose files a Mod
+// touches. It returns nil when everything has to be reloaded: when there is
+// only one config, or when a nested config was added or removed.
+func (mr *ModRunner) changedConfigs(mod *moddwatch.Mod) []int {
+	files := mr.configs()
+	if len(files) == 1 {
+		return nil
+	}
+	if mr.Options.Recursive {
+		for _, p := range append(mod.Added, mod.Deleted...) {
+			if path.Base(p) == ConfName {
+				return nil
+			}
+		}
+	}
+	root, err := mr.watchRoot()
+	if err != nil {
+		return nil
+	}
+	ret := []int{}
+	for i, cf := range files {
+		paths := append([]string{cf.path, localConfPath(cf.path)}, cf.config.Includes...)
+		for _, p := range paths {
+			abs, err := filepath.Abs(p)
+			if err == nil && mod.Has(rebase(filepath.ToSlash(abs), root, root)) {
+				ret = append(ret, i)
+				break
+			}
+		}
+	}
+	return ret
+}
+
+// reloadConfig re-reads one of several configs. Its daemons are replaced, and
+// its blocks run as they do on startup. If the config has errors, the old one
+// keeps running.
+func (mr *ModRunner) reloadConfig(i int, dworld *DaemonWorld) {
+	cf := mr.files[i]
+	mr.Log.Notice("Reloading config %s", cf.path)
+	cnf, err := mr.readConfigFile(cf.path, cf.root)
+	if err != nil {
+		mr.Log.Warn("%s", err)
+		return
+	}
+	cnf.FilterBlocks(mr.Options.Only, mr.Options.Skip)
+	w, err := NewDaemonWorld(cnf, cf.log)
+	if err != nil {
+		mr.Log.Warn("%s", err)
+		return
+	}
+	start := 0
+	for _, f := range mr.files[:i] {
+		start += len(f.config.Blocks)
+	}
+	old := dworld.replace(start, len(cf.config.Blocks), w.DaemonPens)
+	for _, dp := range old {
+		dp.Shutdown(os.Kill)
+	}
+	cf.config = cnf
+	if i == 0 {
+		mr.Config = cnf
+	}
+	// Block indexes may have shifted
+	mr.interrupted = nil
+	var runs []*blockRun
+	for j, b := range cnf.Blocks {
+		runs = append(runs, &blockRun{cf: cf, b: b, dpen: w.DaemonPens[j], index: start + j})
+	}
+	mr.runBlocks(runs)
+}
+
 // Gives control of chan to caller
 func (mr *ModRunner) runOnChan(modchan chan *moddwatch.Mod, readyCallback func()) error {
-	dworld, err := NewDaemonWorld(mr.Config, mr.Log)
-	if err != nil {
-		return err
+	dworld := &DaemonWorld{}
+	for _, cf := range mr.configs() {
+		w, err := NewDaemonWorld(cf.config, cf.log)
+		if err != nil {
+			return err
+		}
+		dworld.DaemonPens = append(dworld.DaemonPens, w.DaemonPens...)
 	}
 	defer dworld.Shutdown(os.Kill)
 
@@ -254,35 +818,56 @@ func (mr *ModRunner) runOnChan(modchan chan *moddwatch.Mod, readyCallback func()
 		}
 	}()
 
-	ipatts := mr.Config.IncludePatterns()
-	if mr.ConfReload {
-		ipatts = append(ipatts, filepath.Dir(mr.ConfPath))
-	}
-
-	currentDir, err := os.Getwd()
+	root, err := mr.watchRoot()
 	if err != nil {
 		return err
 	}
 	// FIXME: This takes a long time. We could start it in parallel with the
 	// first process run in a goroutine
-	watcher, err := moddwatch.Watch(currentDir, ipatts, []string{}, lullTime, modchan)
-
+	watcher, err := mr.watch(root, modchan)
 	if err != nil {
-		return fmt.Errorf("Error watching: %s", err)
+		return err
 	}
-	defer watcher.Stop()
+	defer func() { watcher.Stop() }()
 
-	mr.trigger(currentDir, nil, dworld)
+	mr.interrupted = nil
+	queued := mr.trigger(root, nil, dworld, modchan)
 	go readyCallback()
-	for mod := range modchan {
+	for {
+		var mod *moddwatch.Mod
+		if len(queued) > 0 {
+			mod, queued = queued[0], queued[1:]
+		} else {
+			mod = <-modchan
+		}
 		if mod == nil {
 			break
 		}
 		if mod == sentinel {
 			return fmt.Errorf("shutdown")
 		}
-		if mr.ConfReload && mod.Has(mr.ConfPath) {
-			mr.Log.Notice("Reloading config %s", mr.ConfPath)
+		if mr.ConfReload && mr.confChanged(mod) {
+			if changed := mr.changedConfigs(mod); changed != nil {
+				// Only the configs that changed are reloaded, and the
+				// others keep running
+				for _, i := range changed {
+					mr.reloadConfig(i, dworld)
+				}
+				// The old watcher is stopped first, so that no change is
+				// forwarded by both
+				watcher.Stop()
+				w, err := mr.watch(root, modchan)
+				if err != nil {
+					return err
+				}
+				watcher = w
+				continue
+			}
+			if len(mr.configs()) > 1 || mr.ConfPath == "" {
+				mr.Log.Notice("Reloading configs")
+			} else {
+				mr.Log.Notice("Reloading config %s", mr.ConfPath)
+			}
 			err := mr.ReadConfig()
 			if err != nil {
 				mr.Log.Warn("%s", err)
@@ -292,7 +877,7 @@ func (mr *ModRunner) runOnChan(modchan chan *moddwatch.Mod, readyCallback func()
 			}
 		}
 		mr.Log.SayAs("debug", "Delta: \n%s", mod.String())
-		mr.trigger(currentDir, mod, dworld)
+		queued = append(queued, mr.trigger(root, mod, dworld, modchan)...)
 	}
 	return nil
 }
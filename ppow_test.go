@@ -1,9 +1,11 @@
 package ppow
 
 import (
+	"encoding/json"
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"strings"
 	"testing"
 	"time"
@@ -11,6 +13,7 @@ import (
 	"github.com/cortesi/moddwatch"
 	"github.com/dottedmag/ppow/conf"
 	"github.com/dottedmag/termlog"
+	"github.com/google/go-cmp/cmp"
 )
 
 const timeout = 5 * time.Second
@@ -223,3 +226,289 @@ func TestWatch(t *testing.T) {
 		},
 	)
 }
+
+func TestDumpConfig(t *testing.T) {
+	defer withTempDir(t)()
+	text := "@port = 80\n" +
+		"src/** {\n" +
+		"    name: web\n" +
+		"    @bin = ./server\n" +
+		"    daemon +sigterm: @bin -p @port\n" +
+		"}\n"
+	if err := os.WriteFile("ppow.conf", []byte(text), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mr, err := NewModRunner("ppow.conf", termlog.NewLog(), nil, false, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dump, err := DumpConfig(mr.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := dump.Blocks[0].Daemons[0]
+	if d.Command != "@bin -p @port" || d.Rendered != "./server -p 80" || d.Signal != "sigterm" {
+		t.Errorf("Unexpected daemon: %+v", d)
+	}
+	if !reflect.DeepEqual(dump.Blocks[0].Exclude, CommonExcludes) {
+		t.Errorf("Expected the common excludes, got %v", dump.Blocks[0].Exclude)
+	}
+
+	// The dump can be read back, and the common excludes aren't doubled
+	data, err := json.Marshal(dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("ppow.json", data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mr, err = NewModRunner("ppow.json", termlog.NewLog(), nil, false, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := DumpConfig(mr.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again.Blocks[0].Source = "ppow.conf"
+	again.Blocks[0].Line = 2
+	if !reflect.DeepEqual(dump, again) {
+		t.Errorf("Expected\n%+v\ngot\n%+v", dump, again)
+	}
+}
+
+func TestRecursive(t *testing.T) {
+	defer withTempDir(t)()
+	for _, f := range []string{"ppow.conf", "api/ppow.conf", "web/app/ppow.conf", "node_modules/x/ppow.conf"} {
+		if err := os.MkdirAll(filepath.Dir(f), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(f, []byte("src/** {\n    prep: echo\n}\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mr, err := NewModRunner("ppow.conf", termlog.NewLog(), nil, true, Options{Recursive: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths, roots []string
+	for _, cf := range mr.configs() {
+		paths = append(paths, filepath.ToSlash(cf.path))
+		roots = append(roots, filepath.ToSlash(cf.config.Blocks[0].Root))
+	}
+	if diff := cmp.Diff([]string{"ppow.conf", "api/ppow.conf", "web/app/ppow.conf"}, paths); diff != "" {
+		t.Error(diff)
+	}
+	cwd, _ := os.Getwd()
+	expected := []string{"", filepath.ToSlash(filepath.Join(cwd, "api")), filepath.ToSlash(filepath.Join(cwd, "web/app"))}
+	if diff := cmp.Diff(expected, roots); diff != "" {
+		t.Error(diff)
+	}
+	if !mr.confChanged(&moddwatch.Mod{Added: []string{"docs/ppow.conf"}}) {
+		t.Error("Expected a new config to be a config change")
+	}
+	if mr.confChanged(&moddwatch.Mod{Changed: []string{"api/src/main.go"}}) {
+		t.Error("Expected a source change not to be a config change")
+	}
+}
+
+// blockNames lists the names of the blocks of each config
+func blockNames(mr *ModRunner) [][]string {
+	var ret [][]string
+	for _, cf := range mr.configs() {
+		names := []string{}
+		for _, b := range cf.config.Blocks {
+			names = append(names, b.Name)
+		}
+		ret = append(ret, names)
+	}
+	return ret
+}
+
+func TestRecursiveSelection(t *testing.T) {
+	defer withTempDir(t)()
+	files := map[string]string{
+		"api/ppow.conf": "{\n    name: api\n}\n{\n    name: lint\n}\n" +
+			"profile ci {\n    {\n        name: ci\n    }\n}\n",
+		"web/ppow.conf": "{\n    name: web\n}\n",
+	}
+	for f, text := range files {
+		if err := os.MkdirAll(filepath.Dir(f), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(f, []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts := Options{Recursive: true, Only: []string{"api", "ci"}, Profile: "ci"}
+	mr, err := NewModRunner("", termlog.NewLog(), nil, true, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([][]string{{"api", "ci"}, {}}, blockNames(mr)); diff != "" {
+		t.Error(diff)
+	}
+
+	opts = Options{Recursive: true, Skip: []string{"web"}}
+	if mr, err = NewModRunner("", termlog.NewLog(), nil, true, opts); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([][]string{{"api", "lint"}, {}}, blockNames(mr)); diff != "" {
+		t.Error(diff)
+	}
+
+	for _, opts := range []Options{
+		{Recursive: true, Only: []string{"nope"}},
+		{Recursive: true, Profile: "nope"},
+	} {
+		if _, err := NewModRunner("", termlog.NewLog(), nil, true, opts); err == nil {
+			t.Errorf("Expected an error for %+v", opts)
+		}
+	}
+}
+
+func TestExtraConfigs(t *testing.T) {
+	defer withTempDir(t)()
+	for _, f := range []string{"fe", "be"} {
+		if err := os.MkdirAll(f, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		text := "@team = " + f + "\nsrc/** {\n    prep: echo @team\n}\n"
+		if err := os.WriteFile(filepath.Join(f, "ppow.conf"), []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts := Options{Root: "fe", Extra: []ExtraConfig{{Path: "be/ppow.conf", Root: "be"}}}
+	mr, err := NewModRunner("fe/ppow.conf", termlog.NewLog(), nil, true, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := mr.configs()
+	if len(files) != 2 || files[0].config != mr.Config {
+		t.Fatalf("Expected the main config and one more, got %v", files)
+	}
+	for i, team := range []string{"fe", "be"} {
+		vars := files[i].config.GetVariables()
+		if vars["@team"] != team || !strings.HasSuffix(vars["@confdir"], "/"+team) {
+			t.Errorf("Unexpected variables for %s: %v", team, vars)
+		}
+	}
+	ret := mr.changedConfigs(&moddwatch.Mod{Changed: []string{"be/ppow.conf"}})
+	if diff := cmp.Diff([]int{1}, ret); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestExtraConfigsSelection(t *testing.T) {
+	defer withTempDir(t)()
+	for _, f := range []string{"fe", "be"} {
+		if err := os.MkdirAll(f, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		text := "{\n    name: " + f + "\n}\n{\n    name: " + f + "-lint\n}\n"
+		if err := os.WriteFile(filepath.Join(f, "ppow.conf"), []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts := Options{Root: "fe", Extra: []ExtraConfig{{Path: "be/ppow.conf", Root: "be"}}, Only: []string{"be"}}
+	mr, err := NewModRunner("fe/ppow.conf", termlog.NewLog(), nil, true, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([][]string{{}, {"be"}}, blockNames(mr)); diff != "" {
+		t.Error(diff)
+	}
+
+	opts.Only = []string{"api"}
+	if _, err := NewModRunner("fe/ppow.conf", termlog.NewLog(), nil, true, opts); err == nil || err.Error() != `no block named "api"` {
+		t.Errorf("Expected an unknown block error, got %v", err)
+	}
+}
+
+func TestConcurrentBlocks(t *testing.T) {
+	defer withTempDir(t)()
+	if err := os.MkdirAll("sub", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	cnf, err := conf.Parse("test", `
++concurrent {
+    prep: sleep 0.5; echo ":a:" ok
+}
++concurrent {
+    indir: sub
+    prep: sleep 0.5; echo ":b:" $(basename $(pwd))
+}
+{
+    prep: echo ":c:" ok
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{Log: lt.Log, Config: cnf, Options: Options{Jobs: 3}}
+	dworld, err := NewDaemonWorld(cnf, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	mr.trigger(wd, nil, dworld, nil)
+	if d := time.Since(start); d > 900*time.Millisecond {
+		t.Errorf("Expected the blocks to run at the same time, but they took %s", d)
+	}
+	ret := events(lt.String())
+	sort.Strings(ret)
+	if diff := cmp.Diff([]string{":a: ok", ":b: sub", ":c: ok"}, ret); diff != "" {
+		t.Error(diff)
+	}
+	if now, _ := os.Getwd(); now != wd {
+		t.Errorf("Expected the working directory to stay %s, got %s", wd, now)
+	}
+}
+
+func TestRestartOnChange(t *testing.T) {
+	defer withTempDir(t)()
+	cnf, err := conf.Parse("test", `
+*.txt +restart-on-change {
+    prep: echo ":run:" @mods; test -e done || sleep 10
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	mr := ModRunner{Log: lt.Log, Config: cnf}
+	dworld, err := NewDaemonWorld(cnf, lt.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	modchan := make(chan *moddwatch.Mod, 1)
+	next := &moddwatch.Mod{Changed: []string{"b.txt"}}
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		modchan <- next
+	}()
+	start := time.Now()
+	queued := mr.trigger(wd, &moddwatch.Mod{Changed: []string{"a.txt"}}, dworld, modchan)
+	if d := time.Since(start); d > TimeoutGrace {
+		t.Errorf("Expected the prep to be stopped, but it ran for %s", d)
+	}
+	if len(queued) != 1 || queued[0] != next {
+		t.Fatalf("Expected the new changes to be queued, got %v", queued)
+	}
+
+	touch("done")
+	mr.trigger(wd, next, dworld, nil)
+	expected := []string{":run: ./a.txt", ":run: ./a.txt ./b.txt"}
+	if diff := cmp.Diff(expected, events(lt.String())); diff != "" {
+		t.Error(diff)
+	}
+}
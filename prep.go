@@ -1,6 +1,10 @@
 package ppow
 
 import (
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/cortesi/moddwatch"
@@ -8,36 +12,149 @@ import (
 	"github.com/dottedmag/termlog"
 )
 
+// TimeoutGrace is how long a prep command that timed out has to exit after
+// it's sent SIGTERM, before it's killed
+const TimeoutGrace = 5 * time.Second
+
+const prepTimeoutVarName = "@preptimeout"
+
+// ProcErrorKind tells why a process failed
+type ProcErrorKind int
+
+const (
+	// ProcFailed means the process exited with an error
+	ProcFailed ProcErrorKind = iota
+	// ProcTimedOut means the process was stopped because it ran for too long
+	ProcTimedOut
+	// ProcStopped means the process was stopped because new changes arrived
+	ProcStopped
+)
+
+// errStopped is returned for prep commands stopped by new changes
+var errStopped = ProcError{"stopped by new changes", "", ProcStopped}
+
 // ProcError is a process error, possibly containing command output
 type ProcError struct {
 	shorttext string
 	Output    string
+	Kind      ProcErrorKind
 }
 
 func (p ProcError) Error() string {
 	return p.shorttext
 }
 
-// RunProc runs a process to completion, sending output to log
-func RunProc(cmd string, shellMethod string, dir string, log termlog.Stream) error {
+// RunProc runs a process to completion, sending output to log. If timeout
+// isn't zero, the process group is sent SIGTERM once it has passed, and killed
+// if it's still running TimeoutGrace later. The same happens when stop is
+// closed.
+func RunProc(cmd string, shellMethod string, dir string, timeout time.Duration, stop <-chan struct{}, log termlog.Stream) error {
+	if isClosed(stop) {
+		return errStopped
+	}
 	log.Header()
 	ex, err := NewExecutor(shellMethod, cmd, dir)
 	if err != nil {
 		return err
 	}
 	start := time.Now()
+	done := make(chan struct{})
+	// Why the process was stopped, or ProcFailed if it wasn't
+	reason := make(chan ProcErrorKind, 1)
+	go func() {
+		var expired <-chan time.Time
+		if timeout > 0 {
+			expired = time.After(timeout)
+		}
+		select {
+		case <-done:
+			reason <- ProcFailed
+			return
+		case <-expired:
+			reason <- ProcTimedOut
+			log.Warn(">> timed out after %s, sending signal %s", timeout, syscall.SIGTERM)
+		case <-stop:
+			reason <- ProcStopped
+			log.Warn(">> new changes, sending signal %s", syscall.SIGTERM)
+		}
+		signalRunning(ex, syscall.SIGTERM, done)
+		select {
+		case <-done:
+		case <-time.After(TimeoutGrace):
+			log.Warn(">> still running, sending signal %s", os.Kill)
+			signalRunning(ex, os.Kill, done)
+		}
+	}()
 	err, estate := ex.Run(log, true)
+	close(done)
+	switch <-reason {
+	case ProcTimedOut:
+		msg := fmt.Sprintf("timed out after %s", timeout)
+		log.Shout("%s", msg)
+		output := ""
+		if estate != nil {
+			output = estate.ErrOutput
+		}
+		return ProcError{msg, output, ProcTimedOut}
+	case ProcStopped:
+		log.Notice(">> %s", errStopped)
+		return errStopped
+	}
 	if err != nil {
 		return err
 	} else if estate.Error != nil {
 		log.Shout("%s", estate.Error)
-		return ProcError{estate.Error.Error(), estate.ErrOutput}
+		return ProcError{estate.Error.Error(), estate.ErrOutput, ProcFailed}
 	}
 	log.Notice(">> done (%s)", time.Since(start))
 	return nil
 }
 
-// RunPreps runs all commands in sequence. Stops if any command returns an error.
+// signalRunning signals an executor's process group, waiting for the process
+// to start if it hasn't yet, until done is closed
+func signalRunning(ex *Executor, sig os.Signal, done <-chan struct{}) {
+	for ex.Signal(sig) != nil {
+		select {
+		case <-done:
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// isClosed reports whether a channel has been closed. A nil channel never is.
+func isClosed(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// prepTimeout returns the default timeout of prep commands, set with
+// @preptimeout
+func prepTimeout(vars map[string]string) (time.Duration, error) {
+	v := vars[prepTimeoutVarName]
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("Invalid %s %q, expected a duration like 90s or 5m", prepTimeoutVarName, v)
+	}
+	return d, nil
+}
+
+// RunPreps runs all commands in sequence, except that consecutive commands
+// flagged with +parallel run at the same time, and the commands after them
+// wait for all of them. After a command fails, only the commands flagged with
+// +always run. Failures of commands flagged with
+// +allowfail are reported, but don't stop the block. RunPreps returns the
+// first failure that stops the block, or with +strict, the first failure of
+// any command: daemons should then not be restarted. When stop is closed, the
+// running commands are stopped, and a ProcError with the kind ProcStopped is
+// returned.
 func RunPreps(
 	b conf.Block,
 	vars map[string]string,
@@ -45,10 +162,16 @@ func RunPreps(
 	log termlog.TermLog,
 	notifiers []Notifier,
 	initial bool,
+	stop <-chan struct{},
 ) error {
+	vars = b.Scope(vars)
 	sh, err := GetShellName(vars[shellVarName])
 	if err != nil {
-		return err
+		return blockError(&b, err)
+	}
+	defaultTimeout, err := prepTimeout(vars)
+	if err != nil {
+		return blockError(&b, err)
 	}
 
 	var modified []string
@@ -57,24 +180,148 @@ func RunPreps(
 	}
 
 	vcmd := VarCmd{Block: &b, Modified: modified, Vars: vars}
-	for _, p := range b.Preps {
-		cmd, err := vcmd.Render(p.Command)
-		if initial && p.Onchange {
-			log.Say(niceHeader("skipping prep: ", cmd))
-			continue
+	var failed, allowed error
+	for _, group := range prepGroups(b.Preps) {
+		if isClosed(stop) {
+			return errStopped
 		}
-		if err != nil {
-			return err
+		var jobs []*prepJob
+		for _, p := range group {
+			if failed != nil && !p.Always {
+				continue
+			}
+			cmd, err := vcmd.Render(p.Command)
+			if initial && p.Onchange {
+				log.Say(niceHeader(blockPreamble(&b, "skipping prep: "), cmd))
+				continue
+			}
+			jobs = append(jobs, &prepJob{prep: p, cmd: cmd, err: err})
+		}
+		runPrepJobs(&b, jobs, sh, defaultTimeout, stop, log)
+		if isClosed(stop) {
+			return errStopped
 		}
-		err = RunProc(cmd, sh, b.InDir, log.Stream(niceHeader("prep: ", cmd)))
-		if err != nil {
+		for _, j := range jobs {
+			err := j.err
+			if err == nil {
+				continue
+			}
 			if pe, ok := err.(ProcError); ok {
+				title := "ppow error"
+				if pe.Kind == ProcTimedOut {
+					title = "ppow timeout"
+				}
+				if b.Name != "" {
+					title += ": " + b.Name
+				}
 				for _, n := range notifiers {
-					n.Push("ppow error", pe.Output, "")
+					n.Push(title, pe.Output, "")
 				}
+			} else {
+				err = blockError(&b, err)
+			}
+			// Only the first failure of each kind is returned, and the caller
+			// reports it
+			if j.prep.AllowFail && allowed == nil {
+				allowed = err
+			} else if !j.prep.AllowFail && failed == nil {
+				failed = err
+			} else {
+				shoutError(log, err)
 			}
+		}
+	}
+	if failed == nil && b.Strict {
+		return allowed
+	}
+	if allowed != nil {
+		shoutError(log, allowed)
+	}
+	return failed
+}
+
+// prepGroups splits prep commands into the groups that run one after the
+// other. Consecutive +parallel commands form a group; every other command is
+// a group of its own.
+func prepGroups(preps []conf.Prep) [][]conf.Prep {
+	var ret [][]conf.Prep
+	for i := 0; i < len(preps); {
+		n := 1
+		for preps[i].Parallel && i+n < len(preps) && preps[i+n].Parallel {
+			n++
+		}
+		ret = append(ret, preps[i:i+n])
+		i += n
+	}
+	return ret
+}
+
+// prepJob is a prep command to run, and the error it failed with
+type prepJob struct {
+	prep conf.Prep
+	cmd  string
+	err  error
+}
+
+// runPrepJobs runs a group of prep commands at the same time, and waits for
+// them all to finish. The output of each command is held back until it's
+// done, so that it isn't interleaved with the others.
+func runPrepJobs(b *conf.Block, jobs []*prepJob, shellMethod string, defaultTimeout time.Duration, stop <-chan struct{}, log termlog.TermLog) {
+	var wg sync.WaitGroup
+	var flushLock sync.Mutex
+	for _, j := range jobs {
+		if j.err != nil {
+			continue
+		}
+		timeout := j.prep.Timeout
+		if timeout == 0 {
+			timeout = defaultTimeout
+		}
+		stream := log.Stream(niceHeader(blockPreamble(b, "prep: "), j.cmd))
+		if len(jobs) == 1 {
+			j.err = runPrep(j.prep, j.cmd, shellMethod, blockDir(b), timeout, stop, stream)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := &bufferedStream{}
+			j.err = runPrep(j.prep, j.cmd, shellMethod, blockDir(b), timeout, stop, buf)
+			flushLock.Lock()
+			defer flushLock.Unlock()
+			buf.flush(stream)
+		}()
+	}
+	wg.Wait()
+}
+
+// runPrep runs a prep command, and runs it again as many times as its +retry
+// option allows while it fails. Every attempt is logged to the same stream.
+func runPrep(p conf.Prep, cmd string, shellMethod string, dir string, timeout time.Duration, stop <-chan struct{}, log termlog.Stream) error {
+	backoff := p.Backoff
+	for attempt := 1; ; attempt++ {
+		err := RunProc(cmd, shellMethod, dir, timeout, stop, log)
+		if pe, ok := err.(ProcError); !ok || pe.Kind == ProcStopped || attempt > p.Retries {
 			return err
 		}
+		if backoff > 0 {
+			log.Warn(">> attempt %d of %d failed, retrying in %s", attempt, p.Retries+1, backoff)
+			select {
+			case <-time.After(backoff):
+			case <-stop:
+				return errStopped
+			}
+			backoff *= 2
+		} else {
+			log.Warn(">> attempt %d of %d failed, retrying", attempt, p.Retries+1)
+		}
+	}
+}
+
+// shoutError logs an error that isn't returned. ProcErrors have already been
+// logged with the output of their command.
+func shoutError(log termlog.TermLog, err error) {
+	if _, ok := err.(ProcError); !ok {
+		log.Shout("%s", err)
 	}
-	return nil
 }
@@ -0,0 +1,208 @@
+package ppow
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dottedmag/ppow/conf"
+	"github.com/dottedmag/termlog"
+)
+
+func TestRunPrepsBlockVariables(t *testing.T) {
+	cnf, err := conf.Parse("test", `
+@a = global
+@b = global
+{
+    @a = block
+    prep: echo ":@a:@b:"
+}
+{
+    name: broken
+    prep: echo @missing
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	err = RunPreps(cnf.Blocks[0], cnf.GetVariables(), nil, lt.Log, nil, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(lt.String(), ":block:global:") {
+		t.Errorf("Block variable did not shadow global:\n%s", lt.String())
+	}
+
+	err = RunPreps(cnf.Blocks[1], cnf.GetVariables(), nil, lt.Log, nil, true, nil)
+	expected := "test:8: block broken: No such variable: @missing"
+	if err == nil || err.Error() != expected {
+		t.Errorf("Expected error %q, got %v", expected, err)
+	}
+}
+
+// countNotifier counts the notifications pushed to it
+type countNotifier struct {
+	count int
+}
+
+func (n *countNotifier) Push(title string, content string, icon string) {
+	n.count++
+}
+
+func TestRunPrepsFailures(t *testing.T) {
+	cnf, err := conf.Parse("test", `
+{
+    prep +allowfail: echo ":lint:"; exit 1
+    prep: echo ":build:"
+    prep: exit 2
+    prep: echo ":skipped:"
+    prep +always: echo ":cleanup:"
+}
+{
+    prep +allowfail: exit 1
+    prep: echo ":ok:"
+}
++strict {
+    prep +allowfail: exit 1
+    prep: echo ":ok:"
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	n := &countNotifier{}
+	err = RunPreps(cnf.Blocks[0], cnf.GetVariables(), nil, lt.Log, []Notifier{n}, true, nil)
+	if _, ok := err.(ProcError); !ok {
+		t.Errorf("Expected a ProcError, got %v", err)
+	}
+	out := lt.String()
+	for _, s := range []string{":lint:", ":build:", ":cleanup:"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("Expected %s in the output:\n%s", s, out)
+		}
+	}
+	if strings.Contains(out, ":skipped:") {
+		t.Errorf("Expected the prep after the failure to be skipped:\n%s", out)
+	}
+	if n.count != 2 {
+		t.Errorf("Expected 2 notifications, got %d", n.count)
+	}
+
+	if err := RunPreps(cnf.Blocks[1], cnf.GetVariables(), nil, lt.Log, nil, true, nil); err != nil {
+		t.Errorf("Expected an allowed failure to let the block succeed, got %v", err)
+	}
+	if err := RunPreps(cnf.Blocks[2], cnf.GetVariables(), nil, lt.Log, nil, true, nil); err == nil {
+		t.Error("Expected an allowed failure to fail a +strict block")
+	}
+}
+
+func TestRunPrepsTimeout(t *testing.T) {
+	cnf, err := conf.Parse("test", `
+@preptimeout = 100ms
+{
+    prep +allowfail: sleep 10
+    prep +timeout=5s: echo ":quick:"
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	n := &countNotifier{}
+	start := time.Now()
+	b := cnf.Blocks[0]
+	b.Strict = true
+	err = RunPreps(b, cnf.GetVariables(), nil, lt.Log, []Notifier{n}, true, nil)
+	if pe, ok := err.(ProcError); !ok || pe.Kind != ProcTimedOut {
+		t.Errorf("Expected a timeout, got %#v", err)
+	}
+	if d := time.Since(start); d > TimeoutGrace {
+		t.Errorf("Expected the command to be stopped, but it ran for %s", d)
+	}
+	if !strings.Contains(lt.String(), "timed out after 100ms") || !strings.Contains(lt.String(), ":quick:") {
+		t.Errorf("Unexpected output:\n%s", lt.String())
+	}
+	if n.count != 1 {
+		t.Errorf("Expected 1 notification, got %d", n.count)
+	}
+}
+
+func TestRunPrepsRetry(t *testing.T) {
+	attempts := filepath.ToSlash(filepath.Join(t.TempDir(), "attempts"))
+	cnf, err := conf.Parse("test", `
+{
+    prep +retry=3: echo x >> '`+attempts+`'; test $(wc -l < '`+attempts+`') -ge 3
+}
+{
+    prep +retry=2,backoff=10ms: echo flaky; exit 1
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	n := &countNotifier{}
+	if err := RunPreps(cnf.Blocks[0], cnf.GetVariables(), nil, lt.Log, []Notifier{n}, true, nil); err != nil {
+		t.Errorf("Expected the command to succeed on the third attempt, got %v", err)
+	}
+	if !strings.Contains(lt.String(), "attempt 2 of 4 failed") || strings.Contains(lt.String(), "attempt 3 of 4") {
+		t.Errorf("Unexpected output:\n%s", lt.String())
+	}
+
+	lt = termlog.NewLogTest()
+	err = RunPreps(cnf.Blocks[1], cnf.GetVariables(), nil, lt.Log, []Notifier{n}, true, nil)
+	if _, ok := err.(ProcError); !ok {
+		t.Errorf("Expected a ProcError, got %v", err)
+	}
+	if c := strings.Count(lt.String(), "\nflaky\n"); c != 3 {
+		t.Errorf("Expected 3 attempts, got %d:\n%s", c, lt.String())
+	}
+	if n.count != 1 {
+		t.Errorf("Expected only the final failure to notify, got %d notifications", n.count)
+	}
+}
+
+func TestRunPrepsParallel(t *testing.T) {
+	cnf, err := conf.Parse("test", `
+{
+    prep +parallel: echo a1; sleep 0.5; echo a2
+    prep +parallel: echo b1; sleep 0.5; echo b2
+    prep: echo c
+}
+{
+    prep +parallel: sleep 0.2; exit 1
+    prep +parallel: echo ok
+    prep: echo skipped
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := termlog.NewLogTest()
+	start := time.Now()
+	if err := RunPreps(cnf.Blocks[0], cnf.GetVariables(), nil, lt.Log, nil, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 900*time.Millisecond {
+		t.Errorf("Expected the group to run in parallel, but it took %s", d)
+	}
+	out := lt.String()
+	if !strings.Contains(out, "a1\na2\n") || !strings.Contains(out, "b1\nb2\n") {
+		t.Errorf("Expected the output of each command to be kept together:\n%s", out)
+	}
+	if c := strings.Index(out, "\nc\n"); c < strings.Index(out, "a2") || c < strings.Index(out, "b2") {
+		t.Errorf("Expected the command after the group to run last:\n%s", out)
+	}
+
+	lt = termlog.NewLogTest()
+	err = RunPreps(cnf.Blocks[1], cnf.GetVariables(), nil, lt.Log, nil, true, nil)
+	if _, ok := err.(ProcError); !ok {
+		t.Errorf("Expected the group to fail, got %v", err)
+	}
+	if strings.Contains(lt.String(), "skipped") || !strings.Contains(lt.String(), "ok") {
+		t.Errorf("Unexpected output:\n%s", lt.String())
+	}
+}
@@ -1,8 +1,10 @@
 package ppow
 
 import (
+	"fmt"
 	"strings"
 
+	"github.com/dottedmag/ppow/conf"
 	"github.com/dottedmag/termlog"
 )
 
@@ -30,3 +32,24 @@ func niceHeader(preamble string, command string) string {
 	command = termlog.DefaultPalette.Header.SprintFunc()(shortCommand(command))
 	return pre + command
 }
+
+// blockPreamble prefixes a header preamble with the name of the block, if it
+// has one.
+func blockPreamble(b *conf.Block, preamble string) string {
+	if b.Name == "" {
+		return preamble
+	}
+	return "[" + b.Name + "] " + preamble
+}
+
+// blockError annotates an error with the position of the block it occurred
+// in, and the block's name if it has one.
+func blockError(b *conf.Block, err error) error {
+	if b.Name != "" {
+		err = fmt.Errorf("block %s: %w", b.Name, err)
+	}
+	if b.Line != 0 {
+		err = fmt.Errorf("%s:%d: %w", b.Source, b.Line, err)
+	}
+	return err
+}
@@ -1,6 +1,11 @@
 package ppow
 
-import "testing"
+import (
+	"errors"
+	"testing"
+
+	"github.com/dottedmag/ppow/conf"
+)
 
 var shortCommandTests = []struct {
 	command  string
@@ -25,3 +30,20 @@ func TestShortCommand(t *testing.T) {
 		}
 	}
 }
+
+func TestBlockPreamble(t *testing.T) {
+	if ret := blockPreamble(&conf.Block{}, "prep: "); ret != "prep: " {
+		t.Errorf("Unexpected preamble %q", ret)
+	}
+	if ret := blockPreamble(&conf.Block{Name: "api"}, "prep: "); ret != "[api] prep: " {
+		t.Errorf("Unexpected preamble %q", ret)
+	}
+	err := blockError(&conf.Block{Name: "api"}, errors.New("failed"))
+	if err.Error() != "block api: failed" {
+		t.Errorf("Unexpected error %q", err)
+	}
+	err = blockError(&conf.Block{Source: "ppow.conf", Line: 3}, errors.New("failed"))
+	if err.Error() != "ppow.conf:3: failed" {
+		t.Errorf("Unexpected error %q", err)
+	}
+}
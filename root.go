@@ -0,0 +1,90 @@
+package ppow
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/cortesi/moddwatch"
+	"github.com/cortesi/moddwatch/filter"
+	"github.com/dottedmag/ppow/conf"
+)
+
+// blockRoot returns the absolute directory a block's patterns are relative
+// to. Blocks without a root are relative to the current directory.
+func blockRoot(b *conf.Block) (string, error) {
+	if b.Root != "" {
+		return filepath.Abs(b.Root)
+	}
+	return os.Getwd()
+}
+
+// blockDir returns the directory a block's commands run in: its indir, or its
+// root. An empty string means the current directory.
+func blockDir(b *conf.Block) string {
+	if b.InDir != "" {
+		return b.InDir
+	}
+	return b.Root
+}
+
+// rebase takes a slash-delimited path or pattern relative to the directory
+// from, and returns it relative to the directory to if it lies underneath it,
+// or as an absolute path otherwise. Absolute paths are only made relative.
+func rebase(p string, from string, to string) string {
+	abs := p
+	if !path.IsAbs(p) && !filepath.IsAbs(filepath.FromSlash(p)) {
+		abs = path.Join(filepath.ToSlash(from), p)
+	}
+	rel, err := filepath.Rel(to, filepath.FromSlash(abs))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return abs
+	}
+	return filepath.ToSlash(rel)
+}
+
+func rebaseAll(paths []string, from string, to string) []string {
+	if from == to || paths == nil {
+		return paths
+	}
+	ret := make([]string, len(paths))
+	for i, p := range paths {
+		ret[i] = rebase(p, from, to)
+	}
+	return ret
+}
+
+// rebaseMod returns a Mod with its paths moved from one root to another
+func rebaseMod(mod *moddwatch.Mod, from string, to string) *moddwatch.Mod {
+	if from == to {
+		return mod
+	}
+	return &moddwatch.Mod{
+		Changed: rebaseAll(mod.Changed, from, to),
+		Deleted: rebaseAll(mod.Deleted, from, to),
+		Added:   rebaseAll(mod.Added, from, to),
+	}
+}
+
+// ListFiles lists the files under root that match the patterns, relative to
+// root. moddwatch.List only matches relative patterns when the root is the
+// current directory, so we give it absolute patterns, and filter what it
+// finds with the relative ones.
+func ListFiles(root string, includes []string, excludes []string) ([]string, error) {
+	if root == "" {
+		return moddwatch.List(".", includes, excludes)
+	}
+	abs := make([]string, len(includes))
+	for i, p := range includes {
+		abs[i] = p
+		if !path.IsAbs(p) && !filepath.IsAbs(filepath.FromSlash(p)) {
+			abs[i] = path.Join(filepath.ToSlash(root), p)
+		}
+	}
+	files, err := moddwatch.List(root, abs, nil)
+	if err != nil {
+		return nil, err
+	}
+	return filter.Files(files, includes, excludes)
+}
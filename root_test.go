@@ -0,0 +1,62 @@
+package ppow
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cortesi/moddwatch"
+	"github.com/google/go-cmp/cmp"
+)
+
+var rebaseTests = []struct {
+	path     string
+	from     string
+	to       string
+	expected string
+}{
+	{"a/b", "/x", "/x", "a/b"},
+	{"a/b", "/x/y", "/x", "y/a/b"},
+	{"**/*.go", "/x/y", "/x", "y/**/*.go"},
+	{"y/a", "/x", "/x/y", "a"},
+	{"a", "/x", "/x/y", "/x/a"},
+	{"../a", "/x/y", "/x", "a"},
+	{"/x/y/a", "/z", "/x", "y/a"},
+	{"/z/a", "/x", "/x", "/z/a"},
+}
+
+func TestRebase(t *testing.T) {
+	if filepath.Separator != '/' {
+		t.Skip("uses POSIX paths")
+	}
+	for _, tt := range rebaseTests {
+		if ret := rebase(tt.path, tt.from, tt.to); ret != tt.expected {
+			t.Errorf("%q from %q to %q: expected %q, got %q", tt.path, tt.from, tt.to, tt.expected, ret)
+		}
+	}
+	mod := &moddwatch.Mod{Changed: []string{"y/a"}, Added: []string{"b"}}
+	expected := &moddwatch.Mod{Changed: []string{"a"}, Added: []string{"/x/b"}}
+	if diff := cmp.Diff(expected, rebaseMod(mod, "/x", "/x/y")); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestListFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, f := range []string{"src/a.go", "src/a_test.go", "b.go"} {
+		path := filepath.Join(dir, filepath.FromSlash(f))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ret, err := ListFiles(dir, []string{"src/**"}, []string{"**/*_test.go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"src/a.go"}, ret); diff != "" {
+		t.Error(diff)
+	}
+}
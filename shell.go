@@ -145,6 +145,38 @@ func (e *Executor) Run(log termlog.Stream, bufferr bool) (error, *ExecState) {
 	return nil, estate
 }
 
+// Output runs the command to completion and returns its standard output.
+// Standard error is collected in the ErrOutput of the returned state.
+func (e *Executor) Output() (string, *ExecState, error) {
+	e.Lock()
+	if e.running() {
+		e.Unlock()
+		return "", nil, fmt.Errorf("already running")
+	}
+	cmd, err := makeCommand(e.Shell, e.Command, e.Dir)
+	if err != nil {
+		e.Unlock()
+		return "", nil, err
+	}
+	stdo := new(bytes.Buffer)
+	stde := new(bytes.Buffer)
+	cmd.Stdout = stdo
+	cmd.Stderr = stde
+	e.cmd = cmd
+	e.Unlock()
+
+	err = cmd.Run()
+	e.reset()
+	if cmd.ProcessState == nil {
+		return "", nil, err
+	}
+	return stdo.String(), &ExecState{
+		Error:     err,
+		ErrOutput: stde.String(),
+		ProcState: cmd.ProcessState.String(),
+	}, nil
+}
+
 func (e *Executor) Signal(sig os.Signal) error {
 	e.Lock()
 	defer e.Unlock()
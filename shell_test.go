@@ -3,6 +3,7 @@ package ppow
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"syscall"
@@ -195,3 +196,35 @@ func TestCaseInsensitivePath(t *testing.T) {
 		},
 	)
 }
+
+func TestEvalCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skipping - needs sh")
+	}
+	out, err := evalCommand("", "", "echo foo; echo bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "foo\nbar" {
+		t.Errorf("Unexpected output %q", out)
+	}
+
+	_, err = evalCommand("sh", "", "echo out; echo oops >&2; exit 3")
+	if err == nil || !strings.Contains(err.Error(), "exit status 3") || !strings.Contains(err.Error(), "oops") {
+		t.Errorf("Expected error with stderr, got %v", err)
+	}
+
+	dir := t.TempDir()
+	out, err = evalCommand("", dir, "pwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if real, _ := filepath.EvalSymlinks(dir); out != dir && out != real {
+		t.Errorf("Expected the command to run in %s, got %q", dir, out)
+	}
+
+	_, err = evalCommand("fish", "", "true")
+	if err == nil {
+		t.Error("Expected error for unsupported shell")
+	}
+}
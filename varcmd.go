@@ -6,12 +6,9 @@ import (
 	"regexp"
 	"strings"
 
-	"github.com/cortesi/moddwatch"
 	"github.com/dottedmag/ppow/conf"
 )
 
-var name = regexp.MustCompile(`(\\*)@\w+`)
-
 func getDirs(paths []string) []string {
 	m := map[string]bool{}
 	for _, p := range paths {
@@ -65,16 +62,32 @@ type VarCmd struct {
 	Vars     map[string]string
 }
 
+// modsRef matches the references to @mods and @dirmods that a config variable
+// can't resolve, since they're only known when a command runs
+var modsRef = regexp.MustCompile(`@(dir)?mods\b`)
+
 // Get a variable by name
 func (v *VarCmd) get(name string) (string, error) {
 	if val, ok := v.Vars[name]; ok {
-		return val, nil
+		if name == "@mods" || name == "@dirmods" || !modsRef.MatchString(val) {
+			return val, nil
+		}
+		// A variable like @files = @mods refers to the changed files
+		var err error
+		val = modsRef.ReplaceAllStringFunc(val, func(ref string) string {
+			mods, errv := v.get(ref)
+			if errv != nil {
+				err = errv
+			}
+			return mods
+		})
+		return val, err
 	}
 	if (name == "@mods" || name == "@dirmods") && v.Block != nil {
 		var modified []string
 		if v.Modified == nil {
 			var err error
-			modified, err = moddwatch.List(".", v.Block.Include, v.Block.Exclude)
+			modified, err = ListFiles(v.Block.Root, v.Block.Include, v.Block.Exclude)
 			if err != nil {
 				return "", err
 			}
@@ -88,38 +101,7 @@ func (v *VarCmd) get(name string) (string, error) {
 	return "", fmt.Errorf("No such variable: %s", name)
 }
 
-const esc = '\\'
-
 // Render renders the command with a map of variables
 func (v *VarCmd) Render(cmd string) (string, error) {
-	var err error
-	cmd = string(
-		name.ReplaceAllFunc(
-			[]byte(cmd),
-			func(key []byte) []byte {
-				cnt := 0
-				for _, c := range key {
-					if c != esc {
-						break
-					}
-					cnt++
-				}
-				ks := strings.TrimLeft(string(key), string(esc))
-				if cnt%2 != 0 {
-					return []byte(strings.Repeat(string(esc), (cnt-1)/2) + ks)
-				}
-				val, errv := v.get(ks)
-				if errv != nil {
-					err = fmt.Errorf("No such variable: %s", ks)
-					return nil
-				}
-				val = strings.Repeat(string(esc), cnt/2) + val
-				return []byte(val)
-			},
-		),
-	)
-	if err != nil {
-		return "", err
-	}
-	return cmd, nil
+	return conf.Expand(cmd, v.get)
 }
@@ -54,6 +54,56 @@ func TestRender(t *testing.T) {
 	}
 }
 
+func TestRenderModsAlias(t *testing.T) {
+	cnf, err := conf.Parse("test", "@files = @mods\n@dirs = in @dirmods\n{\n    prep: echo @files; echo @dirs\n}\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := cnf.Blocks[0]
+	vc := VarCmd{&b, []string{"a/x", "b/y"}, b.Scope(cnf.GetVariables())}
+	ret, err := vc.Render(b.Preps[0].Command)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `echo "./a/x" "./b/y"; echo in "./a" "./b"`
+	if ret != expected && ret != `echo "./a/x" "./b/y"; echo in "./b" "./a"` {
+		t.Errorf("expected %q, got %q", expected, ret)
+	}
+}
+
+func TestRenderEnv(t *testing.T) {
+	t.Setenv("PPOW_TEST_ENV", "val")
+	t.Setenv("PPOW_TEST_EMPTY", "")
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{"@env.PPOW_TEST_ENV", "val"},
+		{"@env.PPOW_TEST_ENV:-def/x", "val"},
+		{"@env.PPOW_TEST_UNSET:-def/x y", "def/x y"},
+		{"@env.PPOW_TEST_EMPTY:-def", "def"},
+		{"@env.PPOW_TEST_EMPTY", ""},
+		{"'@env.PPOW_TEST_UNSET:-'", "''"},
+		{"@env.PPOW_TEST_UNSET:-@foo", "bar"},
+		{`\@env.PPOW_TEST_ENV`, "@env.PPOW_TEST_ENV"},
+	}
+	for _, tt := range tests {
+		vc := VarCmd{&conf.Block{}, nil, map[string]string{"@foo": "bar"}}
+		ret, err := vc.Render(tt.in)
+		if err != nil {
+			t.Errorf("Unexpected error: %s", err)
+		}
+		if ret != tt.out {
+			t.Errorf("expected %q, got %q", tt.out, ret)
+		}
+	}
+	vc := VarCmd{&conf.Block{}, nil, map[string]string{}}
+	_, err := vc.Render("echo @env.PPOW_TEST_UNSET")
+	if err == nil || err.Error() != "environment variable PPOW_TEST_UNSET is not set" {
+		t.Errorf("Expected unset error, got %v", err)
+	}
+}
+
 func TestVarCmd(t *testing.T) {
 	defer withTempDir(t)()
 